@@ -0,0 +1,282 @@
+package sftpd
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/taruti/binp"
+)
+
+// parseAttr parses the ATTRS of the given protocol version into a, whose
+// Flags always use the version 3 meaning.
+func parseAttr(p *binp.Parser, a *Attr, version uint32) *binp.Parser {
+	if version <= 3 {
+		return parseAttrV3(p, a)
+	}
+	var (
+		flags uint32
+		typ   byte
+		skip  uint64
+		skips string
+	)
+	p = p.B32(&flags).Byte(&typ)
+	if flags & SSH_FILEXFER_ATTR_SIZE != 0 {
+		p = p.B64(&a.Size)
+		a.Flags |= SSH_FILEXFER_ATTR_SIZE
+	}
+	if version >= 6 && flags & SSH_FILEXFER_ATTR_ALLOCATION_SIZE != 0 {
+		p = p.B64(&skip)
+	}
+	if flags & SSH_FILEXFER_ATTR_OWNERGROUP != 0 {
+		p = p.B32String(&a.User).B32String(&a.Group)
+		// 数字形式的属主可以直接使用, 名字由会话的 IdentityLookup 解析
+		uid, ue := strconv.ParseUint(a.User, 10, 32)
+		gid, ge := strconv.ParseUint(a.Group, 10, 32)
+		if ue == nil && ge == nil {
+			a.Uid, a.Gid = uint32(uid), uint32(gid)
+			a.Flags |= SSH_FILEXFER_ATTR_UIDGID
+		}
+	}
+	if flags & SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		var mode uint32
+		p = p.B32(&mode)
+		a.Mode = sftpToFileMode(mode) | typeToFileMode(typ)
+		a.Flags |= SSH_FILEXFER_ATTR_PERMISSIONS
+	}
+	subsecond := flags & SSH_FILEXFER_ATTR_SUBSECOND_TIMES != 0
+	if flags & SSH_FILEXFER_ATTR_ACCESSTIME != 0 {
+		p = inTime(p, &a.ATime, subsecond)
+		a.Flags |= SSH_FILEXFER_ATTR_ACMODTIME
+	}
+	if flags & SSH_FILEXFER_ATTR_CREATETIME != 0 {
+		var t time.Time
+		p = inTime(p, &t, subsecond)
+	}
+	if flags & SSH_FILEXFER_ATTR_MODIFYTIME != 0 {
+		p = inTime(p, &a.MTime, subsecond)
+		a.Flags |= SSH_FILEXFER_ATTR_ACMODTIME
+	}
+	if version >= 6 && flags & SSH_FILEXFER_ATTR_CTIME != 0 {
+		var t time.Time
+		p = inTime(p, &t, subsecond)
+	}
+	if flags & SSH_FILEXFER_ATTR_ACL != 0 {
+		p = p.B32String(&skips)
+	}
+	if version >= 5 && flags & SSH_FILEXFER_ATTR_BITS != 0 {
+		var bits, valid uint32
+		p = p.B32(&bits)
+		if version >= 6 {
+			p = p.B32(&valid)
+		}
+	}
+	if version >= 6 {
+		if flags & SSH_FILEXFER_ATTR_TEXT_HINT != 0 {
+			var hint byte
+			p = p.Byte(&hint)
+		}
+		if flags & SSH_FILEXFER_ATTR_MIME_TYPE != 0 {
+			p = p.B32String(&skips)
+		}
+		if flags & SSH_FILEXFER_ATTR_LINK_COUNT != 0 {
+			var links uint32
+			p = p.B32(&links)
+		}
+		if flags & SSH_FILEXFER_ATTR_UNTRANSLATED_NAME != 0 {
+			p = p.B32String(&skips)
+		}
+	}
+	if flags & SSH_FILEXFER_ATTR_EXTENDED != 0 {
+		p = parseExtended(p, a)
+	}
+	return p
+}
+
+func parseAttrV3(p *binp.Parser, a *Attr) *binp.Parser {
+	p = p.B32(&a.Flags)
+	if a.Flags & SSH_FILEXFER_ATTR_SIZE != 0 {
+		p = p.B64(&a.Size)
+	}
+	if a.Flags & SSH_FILEXFER_ATTR_UIDGID != 0 {
+		p = p.B32(&a.Uid).B32(&a.Gid)
+	}
+	if a.Flags & SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		var mode uint32
+		p = p.B32(&mode)
+		a.Mode = sftpToFileMode(mode)
+	}
+	if a.Flags & SSH_FILEXFER_ATTR_ACMODTIME != 0 {
+		p = inTimes(p, a)
+	}
+	if a.Flags & SSH_FILEXFER_ATTR_EXTENDED != 0 {
+		p = parseExtended(p, a)
+	}
+	return p
+}
+
+func parseExtended(p *binp.Parser, a *Attr) *binp.Parser {
+	var count uint32
+	p = p.B32(&count)
+	if count > 0xFF {
+		return nil
+	}
+	ss := make([]string, 2*int(count))
+	for i := 0; i < int(count); i++ {
+		var k, v string
+		p = p.B32String(&k).B32String(&v)
+		ss[2*i+0] = k
+		ss[2*i+1] = v
+	}
+	a.Extended = ss
+	a.Flags |= SSH_FILEXFER_ATTR_EXTENDED
+	return p
+}
+
+// outAttr writes a as the ATTRS of the given protocol version.
+func outAttr(o *binp.Printer, a *Attr, version uint32) {
+	if version <= 3 {
+		outAttrV3(o, a)
+		return
+	}
+	var flags uint32
+	if a.Flags & SSH_FILEXFER_ATTR_SIZE != 0 {
+		flags |= SSH_FILEXFER_ATTR_SIZE
+	}
+	if a.Flags & SSH_FILEXFER_ATTR_UIDGID != 0 {
+		flags |= SSH_FILEXFER_ATTR_OWNERGROUP
+	}
+	if a.Flags & SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		flags |= SSH_FILEXFER_ATTR_PERMISSIONS
+	}
+	if a.Flags & SSH_FILEXFER_ATTR_ACMODTIME != 0 {
+		flags |= SSH_FILEXFER_ATTR_ACCESSTIME | SSH_FILEXFER_ATTR_MODIFYTIME | SSH_FILEXFER_ATTR_SUBSECOND_TIMES
+	}
+	if a.Flags & SSH_FILEXFER_ATTR_EXTENDED != 0 {
+		flags |= SSH_FILEXFER_ATTR_EXTENDED
+	}
+	typ := byte(SSH_FILEXFER_TYPE_UNKNOWN)
+	if a.Flags & SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		typ = fileModeToType(a.Mode)
+	}
+	o.B32(flags).Byte(typ)
+	if flags & SSH_FILEXFER_ATTR_SIZE != 0 {
+		o.B64(a.Size)
+	}
+	if flags & SSH_FILEXFER_ATTR_OWNERGROUP != 0 {
+		user, group := a.User, a.Group
+		if user == "" {
+			user = strconv.FormatUint(uint64(a.Uid), 10)
+		}
+		if group == "" {
+			group = strconv.FormatUint(uint64(a.Gid), 10)
+		}
+		o.B32String(user).B32String(group)
+	}
+	if flags & SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		o.B32(fileModeToSftp(a.Mode))
+	}
+	if flags & SSH_FILEXFER_ATTR_ACCESSTIME != 0 {
+		outTime(o, a.ATime)
+		outTime(o, a.MTime)
+	}
+	if flags & SSH_FILEXFER_ATTR_EXTENDED != 0 {
+		outExtended(o, a)
+	}
+}
+
+func outAttrV3(o *binp.Printer, a *Attr) {
+	o.B32(a.Flags)
+	if a.Flags & SSH_FILEXFER_ATTR_SIZE != 0 {
+		o.B64(a.Size)
+	}
+	if a.Flags & SSH_FILEXFER_ATTR_UIDGID != 0 {
+		o.B32(a.Uid).B32(a.Gid)
+	}
+	if a.Flags & SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		o.B32(fileModeToSftp(a.Mode))
+	}
+	if a.Flags & SSH_FILEXFER_ATTR_ACMODTIME != 0 {
+		outTimes(o, a)
+	}
+	if a.Flags & SSH_FILEXFER_ATTR_EXTENDED != 0 {
+		outExtended(o, a)
+	}
+}
+
+func outExtended(o *binp.Printer, a *Attr) {
+	count := uint32(len(a.Extended) / 2)
+	o.B32(count)
+	for _, s := range a.Extended[:2*count] {
+		o.B32String(s)
+	}
+}
+
+func outTimes(o *binp.Printer, a *Attr) {
+	o.B32(uint32(a.ATime.Unix())).B32(uint32(a.MTime.Unix()))
+}
+
+func inTimes(p *binp.Parser, a *Attr) *binp.Parser {
+	var at, mt uint32
+	p = p.B32(&at).B32(&mt)
+	a.ATime = time.Unix(int64(at), 0)
+	a.MTime = time.Unix(int64(mt), 0)
+	return p
+}
+
+// outTime writes a version 4 time with nanoseconds.
+func outTime(o *binp.Printer, t time.Time) {
+	o.B64(uint64(t.Unix())).B32(uint32(t.Nanosecond()))
+}
+
+func inTime(p *binp.Parser, t *time.Time, subsecond bool) *binp.Parser {
+	var sec uint64
+	var nsec uint32
+	p = p.B64(&sec)
+	if subsecond {
+		p = p.B32(&nsec)
+	}
+	if nsec >= 1e9 {
+		nsec = 0
+	}
+	*t = time.Unix(int64(sec), int64(nsec))
+	return p
+}
+
+func fileModeToType(mode os.FileMode) byte {
+	switch {
+	case mode & os.ModeDir != 0:
+		return SSH_FILEXFER_TYPE_DIRECTORY
+	case mode & os.ModeSymlink != 0:
+		return SSH_FILEXFER_TYPE_SYMLINK
+	case mode & os.ModeNamedPipe != 0:
+		return SSH_FILEXFER_TYPE_FIFO
+	case mode & os.ModeSocket != 0:
+		return SSH_FILEXFER_TYPE_SOCKET
+	case mode & os.ModeCharDevice != 0:
+		return SSH_FILEXFER_TYPE_CHAR_DEVICE
+	case mode & os.ModeDevice != 0:
+		return SSH_FILEXFER_TYPE_BLOCK_DEVICE
+	case mode & os.ModeType == 0:
+		return SSH_FILEXFER_TYPE_REGULAR
+	}
+	return SSH_FILEXFER_TYPE_SPECIAL
+}
+
+func typeToFileMode(typ byte) os.FileMode {
+	switch typ {
+	case SSH_FILEXFER_TYPE_DIRECTORY:
+		return os.ModeDir
+	case SSH_FILEXFER_TYPE_SYMLINK:
+		return os.ModeSymlink
+	case SSH_FILEXFER_TYPE_FIFO:
+		return os.ModeNamedPipe
+	case SSH_FILEXFER_TYPE_SOCKET:
+		return os.ModeSocket
+	case SSH_FILEXFER_TYPE_CHAR_DEVICE:
+		return os.ModeDevice | os.ModeCharDevice
+	case SSH_FILEXFER_TYPE_BLOCK_DEVICE:
+		return os.ModeDevice
+	}
+	return 0
+}
@@ -0,0 +1,194 @@
+package sftpd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/taruti/binp"
+	"github.com/taruti/bytepool"
+)
+
+// Hasher is implemented by files that compute check-file hashes
+// themselves, e.g. on a remote server. CheckFile returns the hash of the
+// range starting at offset of length bytes, 0 meaning up to the end of the
+// file, or when blockSize is not 0 the hashes of every block of the range
+// one after the other. A Hasher that can not hash the file returns a
+// StatusError with SSH_FX_OP_UNSUPPORTED, the server then reads it itself.
+type Hasher interface {
+	CheckFile(algorithm string, offset, length int64, blockSize uint32) ([]byte, error)
+}
+
+// hashes are the check-file algorithms in order of preference.
+var hashes = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha512", sha512.New},
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+	{"md5", md5.New},
+}
+
+// hashNames are announced with check-file-name and check-file-handle.
+var hashNames = func() string {
+	var names []string
+	for _, h := range hashes {
+		names = append(names, h.name)
+	}
+	return strings.Join(names, ",")
+}()
+
+// pickHash returns the first algorithm of a client list that the server
+// knows.
+func pickHash(list string) (string, func() hash.Hash) {
+	for _, name := range strings.Split(list, ",") {
+		for _, h := range hashes {
+			if h.name == strings.TrimSpace(name) {
+				return h.name, h.new
+			}
+		}
+	}
+	return "", nil
+}
+
+// minHashBlock is the smallest block size a client may ask for.
+const minHashBlock = 256
+
+// hashRange computes check-file hashes with ReadAt, the result may not grow
+// beyond max bytes.
+func hashRange(f io.ReaderAt, newHash func() hash.Hash, offset, length int64, blockSize uint32, max int) ([]byte, error) {
+	buf := bytepool.Alloc(copyBufferSize)
+	defer bytepool.Free(buf)
+	var out []byte
+	h := newHash()
+	toEOF := length == 0
+	inBlock := int64(0)
+	for toEOF || length > 0 {
+		bs := buf
+		if !toEOF && length < int64(len(bs)) {
+			bs = bs[:length]
+		}
+		if blockSize > 0 && int64(blockSize)-inBlock < int64(len(bs)) {
+			bs = bs[:int64(blockSize)-inBlock]
+		}
+		n, e := f.ReadAt(bs, offset)
+		if n > 0 {
+			h.Write(bs[:n])
+			offset += int64(n)
+			inBlock += int64(n)
+			if !toEOF {
+				length -= int64(n)
+			}
+			if blockSize > 0 && inBlock == int64(blockSize) {
+				out = h.Sum(out)
+				h.Reset()
+				inBlock = 0
+				if len(out) > max {
+					return nil, errors.New("too many check-file blocks")
+				}
+			}
+		}
+		if e == io.EOF || (e == nil && n == 0) {
+			break
+		}
+		if e != nil {
+			return nil, e
+		}
+	}
+	if blockSize == 0 || inBlock > 0 {
+		out = h.Sum(out)
+	}
+	return out, nil
+}
+
+// checkFile computes the reply of check-file-handle and check-file-name.
+func (s *session) checkFile(id uint32, f File, list string, offset, length uint64, blockSize uint32) error {
+	name, newHash := pickHash(list)
+	if newHash == nil {
+		return s.writeResponse(id, SSH_FX_OP_UNSUPPORTED, errors.New("no supported hash algorithm"))
+	}
+	if blockSize != 0 && blockSize < minHashBlock {
+		return s.writeResponse(id, SSH_FX_INVALID_PARAMETER, errors.New("block size too small"))
+	}
+	var (
+		sum []byte
+		e   error
+	)
+	e = errUnsupported
+	hf, ok := f.(Hasher)
+	if _, has := underlyingFile(f).(Hasher); ok && has {
+		sum, e = hf.CheckFile(name, int64(offset), int64(length), blockSize)
+	}
+	// Hasher 不能计算时通过 ReadAt 计算
+	if statusCode(e) == SSH_FX_OP_UNSUPPORTED {
+		sum, e = hashRange(f, newHash, int64(offset), int64(length), blockSize, s.opts.MaxReadLength)
+	}
+	if e != nil {
+		return s.writeResult(id, e)
+	}
+	var l binp.Len
+	o := binp.Out().LenB32(&l).LenStart(&l).Byte(SSH_FXP_EXTENDED_REPLY).B32(id)
+	o.B32String("check-file").B32String(name).Bytes(sum)
+	o.LenDone(&l)
+	return wrc(s.out, o.Out())
+}
+
+// checkFileHandle serves check-file-handle.
+func (s *session) checkFileHandle(id uint32, p *binp.Parser) error {
+	var (
+		handle, list   string
+		offset, length uint64
+		blockSize      uint32
+	)
+	e := p.B32String(&handle).B32String(&list).B64(&offset).B64(&length).B32(&blockSize).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	f := s.h.GetFile(handle)
+	if f == nil {
+		return s.writeResult(id, errInvalidHandle)
+	}
+	if o := s.h.getOpenFile(handle); o == nil || o.flags&SSH_FXF_READ == 0 {
+		return s.writeResponse(id, SSH_FX_PERMISSION_DENIED, errors.New("handle not opened for reading"))
+	}
+	if s.h.isText(handle) {
+		return s.writeResult(id, errTextHandle)
+	}
+	if e = s.checkRange(handle, offset, length, SSH_FXF_BLOCK_READ); e != nil {
+		return s.writeResult(id, e)
+	}
+	return s.checkFile(id, f, list, offset, length, blockSize)
+}
+
+// checkFileName serves check-file-name.
+func (s *session) checkFileName(id uint32, p *binp.Parser) error {
+	var (
+		name, list     string
+		offset, length uint64
+		blockSize      uint32
+	)
+	e := p.B32String(&name).B32String(&list).B64(&offset).B64(&length).B32(&blockSize).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	name = s.decode(name)
+	o, e := s.lockPath(name, SSH_FXF_READ)
+	if e != nil {
+		return s.writeResult(id, e)
+	}
+	defer o.release()
+	f, e := s.fs.OpenFile(name, SSH_FXF_READ, &Attr{})
+	if e != nil {
+		return s.writeResult(id, e)
+	}
+	defer f.Close()
+	return s.checkFile(id, f, list, offset, length, blockSize)
+}
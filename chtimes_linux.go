@@ -0,0 +1,33 @@
+// +build linux
+
+package sftpd
+
+import (
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// utimeOmit leaves a time unchanged in utimensat(2).
+const utimeOmit = (1 << 30) - 2
+
+// timespecOrOmit converts t, the zero time leaves the time unchanged.
+func timespecOrOmit(t time.Time) unix.Timespec {
+	if t.IsZero() {
+		return unix.Timespec{Nsec: utimeOmit}
+	}
+	return unix.NsecToTimespec(t.UnixNano())
+}
+
+// fileChtimes changes the access and modification times of an open file
+// like futimens(3); a zero time is left unchanged.
+func fileChtimes(f *os.File, atime, mtime time.Time) error {
+	ts := [2]unix.Timespec{timespecOrOmit(atime), timespecOrOmit(mtime)}
+	_, _, errno := unix.Syscall6(unix.SYS_UTIMENSAT, f.Fd(), 0, uintptr(unsafe.Pointer(&ts[0])), 0, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "chtimes", Path: f.Name(), Err: errno}
+	}
+	return nil
+}
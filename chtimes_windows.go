@@ -0,0 +1,19 @@
+// +build windows
+
+package sftpd
+
+import (
+	"os"
+	"time"
+)
+
+// chtimes changes the access and modification times of p, a zero time is
+// left unchanged.
+func chtimes(p string, atime, mtime time.Time) error {
+	return os.Chtimes(p, atime, mtime)
+}
+
+// fileChtimes is chtimes for an open file.
+func fileChtimes(f *os.File, atime, mtime time.Time) error {
+	return os.Chtimes(f.Name(), atime, mtime)
+}
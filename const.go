@@ -23,6 +23,9 @@ const (
 	SSH_FXP_RENAME         = 18
 	SSH_FXP_READLINK       = 19
 	SSH_FXP_SYMLINK        = 20
+	SSH_FXP_LINK           = 21 // v6
+	SSH_FXP_BLOCK          = 22 // v6
+	SSH_FXP_UNBLOCK        = 23 // v6
 	SSH_FXP_STATUS         = 101
 	SSH_FXP_HANDLE         = 102
 	SSH_FXP_DATA           = 103
@@ -42,6 +45,32 @@ const (
 	SSH_FX_NO_CONNECTION     = 6
 	SSH_FX_CONNECTION_LOST   = 7
 	SSH_FX_OP_UNSUPPORTED    = 8
+	// v4
+	SSH_FX_INVALID_HANDLE      = 9
+	SSH_FX_NO_SUCH_PATH        = 10
+	SSH_FX_FILE_ALREADY_EXISTS = 11
+	SSH_FX_WRITE_PROTECT       = 12
+	SSH_FX_NO_MEDIA            = 13
+	// v5
+	SSH_FX_NO_SPACE_ON_FILESYSTEM = 14
+	SSH_FX_QUOTA_EXCEEDED         = 15
+	SSH_FX_UNKNOWN_PRINCIPAL      = 16
+	SSH_FX_LOCK_CONFLICT          = 17
+	// v6
+	SSH_FX_DIR_NOT_EMPTY               = 18
+	SSH_FX_NOT_A_DIRECTORY             = 19
+	SSH_FX_INVALID_FILENAME            = 20
+	SSH_FX_LINK_LOOP                   = 21
+	SSH_FX_CANNOT_DELETE               = 22
+	SSH_FX_INVALID_PARAMETER           = 23
+	SSH_FX_FILE_IS_A_DIRECTORY         = 24
+	SSH_FX_BYTE_RANGE_LOCK_CONFLICT    = 25
+	SSH_FX_BYTE_RANGE_LOCK_REFUSED     = 26
+	SSH_FX_DELETE_PENDING              = 27
+	SSH_FX_FILE_CORRUPT                = 28
+	SSH_FX_OWNER_INVALID               = 29
+	SSH_FX_GROUP_INVALID               = 30
+	SSH_FX_NO_MATCHING_BYTE_RANGE_LOCK = 31
 )
 
 const (
@@ -52,6 +81,36 @@ const (
 	SSH_FILEXFER_ATTR_EXTENDED    = 0x80000000
 )
 
+// 版本 4 及以上的属性标志, 与版本 3 的 ACMODTIME 和 UIDGID 不兼容
+const (
+	SSH_FILEXFER_ATTR_ACCESSTIME        = 0x00000008
+	SSH_FILEXFER_ATTR_CREATETIME        = 0x00000010
+	SSH_FILEXFER_ATTR_MODIFYTIME        = 0x00000020
+	SSH_FILEXFER_ATTR_ACL               = 0x00000040
+	SSH_FILEXFER_ATTR_OWNERGROUP        = 0x00000080
+	SSH_FILEXFER_ATTR_SUBSECOND_TIMES   = 0x00000100
+	SSH_FILEXFER_ATTR_BITS              = 0x00000200 // v5
+	SSH_FILEXFER_ATTR_ALLOCATION_SIZE   = 0x00000400 // v6
+	SSH_FILEXFER_ATTR_TEXT_HINT         = 0x00000800 // v6
+	SSH_FILEXFER_ATTR_MIME_TYPE         = 0x00001000 // v6
+	SSH_FILEXFER_ATTR_LINK_COUNT        = 0x00002000 // v6
+	SSH_FILEXFER_ATTR_UNTRANSLATED_NAME = 0x00004000 // v6
+	SSH_FILEXFER_ATTR_CTIME             = 0x00008000 // v6
+)
+
+// 版本 4 及以上属性中的文件类型
+const (
+	SSH_FILEXFER_TYPE_REGULAR      = 1
+	SSH_FILEXFER_TYPE_DIRECTORY    = 2
+	SSH_FILEXFER_TYPE_SYMLINK      = 3
+	SSH_FILEXFER_TYPE_SPECIAL      = 4
+	SSH_FILEXFER_TYPE_UNKNOWN      = 5
+	SSH_FILEXFER_TYPE_SOCKET       = 6
+	SSH_FILEXFER_TYPE_CHAR_DEVICE  = 7
+	SSH_FILEXFER_TYPE_BLOCK_DEVICE = 8
+	SSH_FILEXFER_TYPE_FIFO         = 9
+)
+
 // sftp 协议中规定文件读写模式
 const (
 	SSH_FXF_READ = 0x00000001
@@ -60,6 +119,58 @@ const (
 	SSH_FXF_CREAT = 0x00000008
 	SSH_FXF_TRUNC = 0x00000010
 	SSH_FXF_EXCL = 0x00000020
+	SSH_FXF_TEXT = 0x00000040 // v4
+)
+
+// 版本 5 及以上 SSH_FXP_OPEN 的 desired-access
+const (
+	ACE4_READ_DATA         = 0x00000001
+	ACE4_WRITE_DATA        = 0x00000002
+	ACE4_APPEND_DATA       = 0x00000004
+	ACE4_READ_NAMED_ATTRS  = 0x00000008
+	ACE4_WRITE_NAMED_ATTRS = 0x00000010
+	ACE4_EXECUTE           = 0x00000020
+	ACE4_DELETE_CHILD      = 0x00000040
+	ACE4_READ_ATTRIBUTES   = 0x00000080
+	ACE4_WRITE_ATTRIBUTES  = 0x00000100
+	ACE4_DELETE            = 0x00010000
+	ACE4_READ_ACL          = 0x00020000
+	ACE4_WRITE_ACL         = 0x00040000
+	ACE4_WRITE_OWNER       = 0x00080000
+	ACE4_SYNCHRONIZE       = 0x00100000
+)
+
+// 版本 5 及以上 SSH_FXP_OPEN 的 flags
+const (
+	SSH_FXF_ACCESS_DISPOSITION = 0x00000007
+	SSH_FXF_CREATE_NEW         = 0x00000000
+	SSH_FXF_CREATE_TRUNCATE    = 0x00000001
+	SSH_FXF_OPEN_EXISTING      = 0x00000002
+	SSH_FXF_OPEN_OR_CREATE     = 0x00000003
+	SSH_FXF_TRUNCATE_EXISTING  = 0x00000004
+	SSH_FXF_APPEND_DATA        = 0x00000008
+	SSH_FXF_APPEND_DATA_ATOMIC = 0x00000010
+	SSH_FXF_TEXT_MODE          = 0x00000020
+	SSH_FXF_BLOCK_READ         = 0x00000040
+	SSH_FXF_BLOCK_WRITE        = 0x00000080
+	SSH_FXF_BLOCK_DELETE       = 0x00000100
+	SSH_FXF_BLOCK_ADVISORY     = 0x00000200 // v6
+	SSH_FXF_NOFOLLOW           = 0x00000400 // v6
+	SSH_FXF_DELETE_ON_CLOSE    = 0x00000800 // v6
+)
+
+// 版本 5 及以上 SSH_FXP_RENAME 的 flags, 也用于 FileSystem.Rename
+const (
+	SSH_FXF_RENAME_OVERWRITE = 0x00000001
+	SSH_FXF_RENAME_ATOMIC    = 0x00000002
+	SSH_FXF_RENAME_NATIVE    = 0x00000004
+)
+
+// 版本 6 SSH_FXP_REALPATH 的 control-byte
+const (
+	SSH_FXP_REALPATH_NO_CHECK    = 0x00000001
+	SSH_FXP_REALPATH_STAT_IF     = 0x00000002
+	SSH_FXP_REALPATH_STAT_ALWAYS = 0x00000003
 )
 
 const S_IFMT = 0xf000
@@ -97,6 +208,9 @@ var SSH_FXP_MAP = map[SSH_FXP]string{
 	SSH_FXP_RENAME:         `SSH_FXP_RENAME`,
 	SSH_FXP_READLINK:       `SSH_FXP_READLINK`,
 	SSH_FXP_SYMLINK:        `SSH_FXP_SYMLINK`,
+	SSH_FXP_LINK:           `SSH_FXP_LINK`,
+	SSH_FXP_BLOCK:          `SSH_FXP_BLOCK`,
+	SSH_FXP_UNBLOCK:        `SSH_FXP_UNBLOCK`,
 	SSH_FXP_STATUS:         `SSH_FXP_STATUS`,
 	SSH_FXP_HANDLE:         `SSH_FXP_HANDLE`,
 	SSH_FXP_DATA:           `SSH_FXP_DATA`,
@@ -124,4 +238,28 @@ var SSH_FX_MAP = map[SSH_FX]string{
 	SSH_FX_NO_CONNECTION:     `SSH_FX_NO_CONNECTION`,
 	SSH_FX_CONNECTION_LOST:   `SSH_FX_CONNECTION_LOST`,
 	SSH_FX_OP_UNSUPPORTED:    `SSH_FX_OP_UNSUPPORTED`,
+
+	SSH_FX_INVALID_HANDLE:              `SSH_FX_INVALID_HANDLE`,
+	SSH_FX_NO_SUCH_PATH:                `SSH_FX_NO_SUCH_PATH`,
+	SSH_FX_FILE_ALREADY_EXISTS:         `SSH_FX_FILE_ALREADY_EXISTS`,
+	SSH_FX_WRITE_PROTECT:               `SSH_FX_WRITE_PROTECT`,
+	SSH_FX_NO_MEDIA:                    `SSH_FX_NO_MEDIA`,
+	SSH_FX_NO_SPACE_ON_FILESYSTEM:      `SSH_FX_NO_SPACE_ON_FILESYSTEM`,
+	SSH_FX_QUOTA_EXCEEDED:              `SSH_FX_QUOTA_EXCEEDED`,
+	SSH_FX_UNKNOWN_PRINCIPAL:           `SSH_FX_UNKNOWN_PRINCIPAL`,
+	SSH_FX_LOCK_CONFLICT:               `SSH_FX_LOCK_CONFLICT`,
+	SSH_FX_DIR_NOT_EMPTY:               `SSH_FX_DIR_NOT_EMPTY`,
+	SSH_FX_NOT_A_DIRECTORY:             `SSH_FX_NOT_A_DIRECTORY`,
+	SSH_FX_INVALID_FILENAME:            `SSH_FX_INVALID_FILENAME`,
+	SSH_FX_LINK_LOOP:                   `SSH_FX_LINK_LOOP`,
+	SSH_FX_CANNOT_DELETE:               `SSH_FX_CANNOT_DELETE`,
+	SSH_FX_INVALID_PARAMETER:           `SSH_FX_INVALID_PARAMETER`,
+	SSH_FX_FILE_IS_A_DIRECTORY:         `SSH_FX_FILE_IS_A_DIRECTORY`,
+	SSH_FX_BYTE_RANGE_LOCK_CONFLICT:    `SSH_FX_BYTE_RANGE_LOCK_CONFLICT`,
+	SSH_FX_BYTE_RANGE_LOCK_REFUSED:     `SSH_FX_BYTE_RANGE_LOCK_REFUSED`,
+	SSH_FX_DELETE_PENDING:              `SSH_FX_DELETE_PENDING`,
+	SSH_FX_FILE_CORRUPT:                `SSH_FX_FILE_CORRUPT`,
+	SSH_FX_OWNER_INVALID:               `SSH_FX_OWNER_INVALID`,
+	SSH_FX_GROUP_INVALID:               `SSH_FX_GROUP_INVALID`,
+	SSH_FX_NO_MATCHING_BYTE_RANGE_LOCK: `SSH_FX_NO_MATCHING_BYTE_RANGE_LOCK`,
 }
\ No newline at end of file
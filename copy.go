@@ -0,0 +1,195 @@
+package sftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+
+	"github.com/taruti/binp"
+	"github.com/taruti/bytepool"
+)
+
+// Copier is implemented by file systems that copy data without passing it
+// through the server, e.g. with copy_file_range(2). CopyData copies length
+// bytes, or everything up to the end of src when length is 0, from src at
+// srcOffset to dst at dstOffset.
+type Copier interface {
+	CopyData(dst File, dstOffset int64, src File, srcOffset, length int64) error
+}
+
+// copyBufferSize is the chunk size of copies through ReadAt and WriteAt.
+const copyBufferSize = 128 * 1024
+
+// copyRange copies like Copier with ReadAt and WriteAt.
+func copyRange(dst io.WriterAt, dstOffset int64, src io.ReaderAt, srcOffset, length int64) error {
+	buf := bytepool.Alloc(copyBufferSize)
+	defer bytepool.Free(buf)
+	for {
+		bs := buf
+		if length > 0 && length < int64(len(bs)) {
+			bs = bs[:length]
+		}
+		n, e := src.ReadAt(bs, srcOffset)
+		if n > 0 {
+			if _, we := dst.WriteAt(bs[:n], dstOffset); we != nil {
+				return we
+			}
+			srcOffset += int64(n)
+			dstOffset += int64(n)
+			if length > 0 {
+				length -= int64(n)
+				if length == 0 {
+					return nil
+				}
+			}
+		}
+		if e == io.EOF || (e == nil && n == 0) {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+	}
+}
+
+func (s *session) copy(dst File, dstOffset int64, src File, srcOffset, length int64) error {
+	if _, ok := underlying(s.fs).(Copier); ok {
+		return s.fs.(Copier).CopyData(dst, dstOffset, src, srcOffset, length)
+	}
+	return copyRange(dst, dstOffset, src, srcOffset, length)
+}
+
+// copyData serves copy-data.
+func (s *session) copyData(id uint32, p *binp.Parser) error {
+	var (
+		rh, wh             string
+		roff, length, woff uint64
+	)
+	e := p.B32String(&rh).B64(&roff).B64(&length).B32String(&wh).B64(&woff).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	src, dst := s.h.GetFile(rh), s.h.GetFile(wh)
+	if src == nil || dst == nil {
+		return s.writeResult(id, errInvalidHandle)
+	}
+	ro, wo := s.h.getOpenFile(rh), s.h.getOpenFile(wh)
+	if ro == nil || ro.flags&SSH_FXF_READ == 0 || wo == nil || wo.flags&SSH_FXF_WRITE == 0 {
+		return s.writeResponse(id, SSH_FX_PERMISSION_DENIED, errors.New("handle not opened for copy"))
+	}
+	if s.h.isText(rh) || s.h.isText(wh) {
+		return s.writeResult(id, errTextHandle)
+	}
+	if rh == wh {
+		// 同一句柄时读写范围不能重叠, 长度为 0 表示到文件末尾
+		if length == 0 {
+			a, e := src.FStat()
+			if e != nil {
+				return s.writeResult(id, e)
+			}
+			if a.Size > roff {
+				length = a.Size - roff
+			}
+		}
+		if roff < woff+length && woff < roff+length {
+			return s.writeResponse(id, SSH_FX_FAILURE, errors.New("overlapping copy"))
+		}
+		if length == 0 {
+			return s.writeResult(id, nil)
+		}
+	}
+	if e = s.checkRange(rh, roff, length, SSH_FXF_BLOCK_READ); e != nil {
+		return s.writeResult(id, e)
+	}
+	if e = s.checkRange(wh, woff, length, SSH_FXF_BLOCK_WRITE); e != nil {
+		return s.writeResult(id, e)
+	}
+	return s.writeResult(id, s.copy(dst, int64(woff), src, int64(roff), int64(length)))
+}
+
+// copyFile serves copy-file.
+func (s *session) copyFile(id uint32, p *binp.Parser) error {
+	var (
+		src, dst  string
+		overwrite byte
+	)
+	e := p.B32String(&src).B32String(&dst).Byte(&overwrite).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	src = s.decode(src)
+	dst = s.decode(dst)
+	return s.writeResult(id, s.copyPath(src, dst, overwrite != 0))
+}
+
+func (s *session) copyPath(src, dst string, overwrite bool) error {
+	if path.Clean(src) == path.Clean(dst) {
+		return &os.PathError{Op: "copy", Path: dst, Err: os.ErrExist}
+	}
+	a, e := s.stat(src, false, 0)
+	if e != nil {
+		return e
+	}
+	if a.Mode.IsDir() {
+		return &os.PathError{Op: "copy", Path: src, Err: errors.New("is a directory")}
+	}
+	ro, e := s.lockPath(src, SSH_FXF_READ)
+	if e != nil {
+		return e
+	}
+	defer ro.release()
+	r, e := s.fs.OpenFile(src, SSH_FXF_READ, &Attr{})
+	if e != nil {
+		return e
+	}
+	defer r.Close()
+	flags := uint32(SSH_FXF_WRITE | SSH_FXF_CREAT | SSH_FXF_TRUNC)
+	if !overwrite {
+		flags |= SSH_FXF_EXCL
+	}
+	wo, e := s.lockPath(dst, flags)
+	if e != nil {
+		return e
+	}
+	defer wo.release()
+	// dst 可能是 src 的硬链接、软链接或者写法不同的同一路径, 确认不是同一个文件之前不能截断,
+	// 复制完成后再截断到 src 的大小
+	w, e := s.fs.OpenFile(dst, flags&^SSH_FXF_TRUNC, &Attr{Flags: ATTR_MODE, Mode: a.Mode.Perm()})
+	if e != nil {
+		return e
+	}
+	if sameFile(r, w) {
+		w.Close()
+		return &os.PathError{Op: "copy", Path: dst, Err: os.ErrExist}
+	}
+	e = s.copy(w, 0, r, 0, 0)
+	if e == nil && overwrite {
+		if a, e = r.FStat(); e == nil {
+			e = w.FSetStat(&Attr{Flags: ATTR_SIZE, Size: a.Size})
+		}
+	}
+	if ce := w.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
+
+// sameFile reports whether a and b are the same file. Only files of LocalFs
+// can tell, those of other file systems are taken to differ; copyPath then
+// copies a file onto itself, which leaves it as it was.
+func sameFile(a, b File) bool {
+	la, ok := underlyingFile(a).(*LocalFile)
+	lb, ok2 := underlyingFile(b).(*LocalFile)
+	if !ok || !ok2 {
+		return false
+	}
+	fa, e := la.file.Stat()
+	if e != nil {
+		return false
+	}
+	fb, e := lb.file.Stat()
+	return e == nil && os.SameFile(fa, fb)
+}
@@ -0,0 +1,47 @@
+// +build linux
+
+package sftpd
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyChunk is the most copy_file_range(2) is asked for at once.
+const copyChunk = 1 << 30
+
+// CopyData copies between two local files inside the kernel with
+// copy_file_range(2), which shares the blocks (reflink) on file systems
+// like btrfs and xfs. Other files, and kernels or file systems that can
+// not do it, are copied through ReadAt and WriteAt.
+func (fs *LocalFs) CopyData(dst File, dstOffset int64, src File, srcOffset, length int64) error {
+	df, ok := dst.(*LocalFile)
+	sf, ok2 := src.(*LocalFile)
+	if !ok || !ok2 {
+		return copyRange(dst, dstOffset, src, srcOffset, length)
+	}
+	for {
+		n := copyChunk
+		if length > 0 && length < int64(n) {
+			n = int(length)
+		}
+		m, e := unix.CopyFileRange(int(sf.file.Fd()), &srcOffset, int(df.file.Fd()), &dstOffset, n, 0)
+		switch e {
+		case nil:
+		case unix.EXDEV, unix.ENOSYS, unix.EINVAL, unix.EOPNOTSUPP:
+			return copyRange(dst, dstOffset, src, srcOffset, length)
+		default:
+			return &os.PathError{Op: "copy_file_range", Path: df.file.Name(), Err: e}
+		}
+		if m == 0 {
+			return nil
+		}
+		if length > 0 {
+			length -= int64(m)
+			if length == 0 {
+				return nil
+			}
+		}
+	}
+}
@@ -3,15 +3,12 @@ package main
 import (
 	"log"
 	"net"
-	"runtime"
 
 	"github.com/leffss/sftpd"
 	"github.com/taruti/sshutil"
 	"golang.org/x/crypto/ssh"
 )
 
-var sysType = runtime.GOOS
-
 func main() {
 	RunServerLowLevel(":2022", sftpd.NewLocalFs("./"))
 }
@@ -91,13 +88,7 @@ func handleConn(conn net.Conn, config *ssh.ServerConfig, fs sftpd.FileSystem) er
 				case sftpd.IsSftpRequest(req):
 					ok = true
 					go func() {
-						var flag int
-						if sysType == "linux" {
-							flag = 1
-						} else {
-							flag = 0
-						}
-						e := sftpd.ServeChannel(channel, fs, flag)
+						e := sftpd.ServeChannel(channel, fs)
 						if e != nil {
 							log.Println("sftpd servechannel failed:", e)
 						}
@@ -3,7 +3,6 @@ package main
 import (
 	"log"
 	"net"
-	"runtime"
 	"time"
 
 	"github.com/leffss/sftpd"
@@ -12,8 +11,6 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-var sysType = runtime.GOOS
-
 func main() {
 	client, _, err := sftpd.NewSshUpstream("192.168.223.111:22", "root", "123456", 5 * time.Second)
 	if err != nil {
@@ -101,7 +98,7 @@ func handleConn(conn net.Conn, config *ssh.ServerConfig, fs sftpd.FileSystem) er
 				case sftpd.IsSftpRequest(req):
 					ok = true
 					go func() {
-						e := sftpd.ServeChannel(channel, fs, 2)
+						e := sftpd.ServeChannel(channel, fs)
 						if e != nil {
 							log.Println("sftpd servechannel failed:", e)
 						}
@@ -0,0 +1,189 @@
+package sftpd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/taruti/binp"
+)
+
+// extension is a SSH_FXP_EXTENDED request implemented by the server.
+type extension struct {
+	// data is announced with the name in SSH_FXP_VERSION.
+	data string
+	// hidden extensions are understood but not announced.
+	hidden bool
+	// handle is set when the request data starts with a handle, requests on
+	// the same handle are then kept in order.
+	handle bool
+	// nextHandle is the number of bytes between the handle and a second
+	// handle the request uses, 0 if there is none.
+	nextHandle int
+	// shared requests may run concurrently with other shared requests on
+	// the same handle or on paths.
+	shared bool
+	// available reports whether the session can serve the extension,
+	// nil means always.
+	available func(s *session) bool
+	// serve handles the request, nil for extensions that are only
+	// announced.
+	serve func(s *session, id uint32, p *binp.Parser) error
+}
+
+var extensions = map[string]*extension{
+	"users-groups-by-id@openssh.com": {
+		data:      "1",
+		shared:    true,
+		available: hasIdentities,
+		serve:     (*session).usersGroupsByID,
+	},
+	"vendor-id": {
+		hidden: true,
+		shared: true,
+		serve:  (*session).vendorID,
+	},
+	"newline": {
+		data:      nativeNewline,
+		available: textAvailable,
+	},
+	"newline@vandyke.com": {
+		hidden:    true,
+		available: textAvailable,
+		serve:     (*session).newlineVandyke,
+	},
+	"posix-rename@openssh.com": {
+		data:  "1",
+		serve: (*session).posixRename,
+	},
+	"fsync@openssh.com": {
+		data:   "1",
+		handle: true,
+		serve:  (*session).fsync,
+	},
+	"check-file-handle": {
+		data:   hashNames,
+		handle: true,
+		shared: true,
+		serve:  (*session).checkFileHandle,
+	},
+	"check-file-name": {
+		data:   hashNames,
+		shared: true,
+		serve:  (*session).checkFileName,
+	},
+	"copy-data": {
+		data:       "1",
+		handle:     true,
+		nextHandle: 8 + 8,
+		serve:      (*session).copyData,
+	},
+	"copy-file": {
+		data:  "1",
+		serve: (*session).copyFile,
+	},
+	"expand-path@openssh.com": {
+		data:   "1",
+		shared: true,
+		serve:  (*session).expandPathExt,
+	},
+	"home-directory": {
+		data:   "1",
+		shared: true,
+		serve:  (*session).homeDirectory,
+	},
+	"hardlink@openssh.com": {
+		data:      "1",
+		available: hasHardLink,
+		serve:     (*session).hardLink,
+	},
+	"limits@openssh.com": {
+		data:   "1",
+		shared: true,
+		serve:  (*session).limits,
+	},
+	"lsetstat@openssh.com": {
+		data:      "1",
+		available: hasLSetStat,
+		serve:     (*session).lsetstat,
+	},
+	"rmdir-recursive@sftpd": {
+		data:      "1",
+		available: recursiveRemoveAvailable,
+		serve:     (*session).rmdirRecursive,
+	},
+	"statvfs@openssh.com": {
+		data:      "2",
+		shared:    true,
+		available: hasStatVFS,
+		serve:     (*session).statVFS,
+	},
+	"fstatvfs@openssh.com": {
+		data:      "2",
+		handle:    true,
+		shared:    true,
+		available: hasStatVFS,
+		serve:     (*session).fstatVFS,
+	},
+}
+
+// announcedExtensions returns the name and data pairs for SSH_FXP_VERSION.
+func (s *session) announcedExtensions() []string {
+	var names []string
+	for name, x := range extensions {
+		if x.hidden || (x.available != nil && !x.available(s)) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, name, extensions[name].data)
+	}
+	return pairs
+}
+
+func (s *session) handleExtended(p *binp.Parser) error {
+	var (
+		id   uint32
+		name string
+	)
+	p = p.B32(&id).B32String(&name)
+	if p == nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, errors.New("SSH_FX_BAD_MESSAGE"))
+		return errors.New("SSH_FX_BAD_MESSAGE")
+	}
+	x := extensions[name]
+	if x == nil || x.serve == nil || (x.available != nil && !x.available(s)) {
+		return s.writeResponse(id, SSH_FX_OP_UNSUPPORTED, fmt.Errorf("UNSUPPORTED SSH_FXP_EXTENDED TYPE: %s", name))
+	}
+	return x.serve(s, id, p)
+}
+
+func (s *session) vendorID(id uint32, p *binp.Parser) error {
+	var (
+		vendorName         string
+		productName        string
+		productVersion     string
+		productBuildNumber uint64
+	)
+	p.B32String(&vendorName).B32String(&productName).B32String(&productVersion).B64(&productBuildNumber)
+	debugf("CLIENT INFO: %s %s %s %d", vendorName, productName, productVersion, productBuildNumber)
+	return s.writeResponse(id, SSH_FX_OK, nil)
+}
+
+// posixRename renames and atomically replaces an existing target, like
+// rename(2), where SSH_FXP_RENAME of version 3 fails.
+func (s *session) posixRename(id uint32, p *binp.Parser) error {
+	var oldName, newName string
+	e := p.B32String(&oldName).B32String(&newName).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	oldName = s.decode(oldName)
+	newName = s.decode(newName)
+	e = s.fs.Rename(oldName, newName, SSH_FXF_RENAME_OVERWRITE|SSH_FXF_RENAME_ATOMIC)
+	return s.writeResult(id, e)
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/pkg/sftp"
+	"golang.org/x/sys/unix"
 )
 
 type Attr struct {
@@ -27,15 +28,21 @@ type Attr struct {
 type NamedAttr struct {
 	Name string
 	Attr
+	// Nlink is the number of hard links, 0 when unknown. Link is the
+	// target of a symbolic link when the Dir read it. Both only appear in
+	// long names.
+	Nlink uint32
+	Link  string
 }
 
 const (
-	ATTR_SIZE    = SSH_FILEXFER_ATTR_SIZE
-	ATTR_UIDGID  = SSH_FILEXFER_ATTR_UIDGID
-	ATTR_MODE    = SSH_FILEXFER_ATTR_PERMISSIONS
-	ATTR_TIME    = SSH_FILEXFER_ATTR_ACMODTIME
-	MODE_REGULAR = os.FileMode(0)
-	MODE_DIR     = os.ModeDir
+	ATTR_SIZE     = SSH_FILEXFER_ATTR_SIZE
+	ATTR_UIDGID   = SSH_FILEXFER_ATTR_UIDGID
+	ATTR_MODE     = SSH_FILEXFER_ATTR_PERMISSIONS
+	ATTR_TIME     = SSH_FILEXFER_ATTR_ACMODTIME
+	ATTR_EXTENDED = SSH_FILEXFER_ATTR_EXTENDED
+	MODE_REGULAR  = os.FileMode(0)
+	MODE_DIR      = os.ModeDir
 )
 
 type Dir interface {
@@ -55,37 +62,55 @@ type FileSystem interface {
 	OpenFile(name string, flags uint32, attr *Attr) (File, error)
 	OpenDir(name string) (Dir, error)
 	Remove(name string) error
+	// Rename fails if new exists unless flags has SSH_FXF_RENAME_OVERWRITE,
+	// which replaces new atomically.
 	Rename(old string, new string, flags uint32) error
 	Mkdir(name string, attr *Attr) error
 	Rmdir(name string) error
 	Stat(name string, islstat bool) (*Attr, error)
 	SetStat(name string, attr *Attr) error
 	ReadLink(path string) (string, error)
+	// CreateLink creates path as a symbolic link to target.
 	CreateLink(path string, target string, flags uint32) error
 	RealPath(path string) (string, error)
 }
 
-// FillFrom fills an Attr from a os.FileInfo
-func (a *Attr) FillFrom(fi os.FileInfo, sysType int) {
+// FillFrom fills an Attr from a os.FileInfo, the owner is taken from the
+// local stat or the sftp attributes behind it when there are any.
+func (a *Attr) FillFrom(fi os.FileInfo) {
 	*a = Attr{}
-	a.Flags = ATTR_SIZE | ATTR_MODE | ATTR_TIME | ATTR_UIDGID
+	a.Flags = ATTR_SIZE | ATTR_MODE | ATTR_TIME
 	a.Size = uint64(fi.Size())
 	a.Mode = fi.Mode()
 	a.MTime = fi.ModTime()
-	// windows 平台下无法使用 *syscall.Stat_t，需使用 *syscall.Win32FileAttributeData
-	// 且 windows 平台下无 Uid 或 Gid
-	if sysType == 1 {
-		info := fi.Sys().(*syscall.Stat_t)
+	switch info := fi.Sys().(type) {
+	case *syscall.Stat_t:
 		a.Uid = info.Uid
 		a.Gid = info.Gid
-	} else if sysType == 2 {
-		info := fi.Sys().(*sftp.FileStat)
+		a.Flags |= ATTR_UIDGID
+	case *unix.Stat_t:
+		a.Uid = info.Uid
+		a.Gid = info.Gid
+		a.Flags |= ATTR_UIDGID
+	case *sftp.FileStat:
 		a.Uid = info.UID
 		a.Gid = info.GID
+		a.Flags |= ATTR_UIDGID
 	}
 	a.ModeString = runLsTypeWord(fi)
 }
 
+// linkCount returns the number of hard links of fi, 0 when it is unknown.
+func linkCount(fi os.FileInfo) uint32 {
+	switch info := fi.Sys().(type) {
+	case *syscall.Stat_t:
+		return uint32(info.Nlink)
+	case *unix.Stat_t:
+		return uint32(info.Nlink)
+	}
+	return 0
+}
+
 // 参考 github.com/pkg/sftp 中 fromFileMode, 识别文件类型的关键函数
 func fileModeToSftp(mode os.FileMode) uint32 {
 	//var raw = uint32(m.Perm())
@@ -0,0 +1,62 @@
+package sftpd
+
+import (
+	"errors"
+	"path"
+
+	"github.com/taruti/binp"
+)
+
+// Syncer is implemented by files that can flush written data to stable
+// storage.
+type Syncer interface {
+	Sync() error
+}
+
+// DirSyncer is implemented by file systems that can flush a directory, so
+// that the entry of a newly created file survives a crash.
+type DirSyncer interface {
+	SyncDir(path string) error
+}
+
+// fsync serves fsync@openssh.com.
+func (s *session) fsync(id uint32, p *binp.Parser) error {
+	var handle string
+	e := p.B32String(&handle).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	f := s.h.GetFile(handle)
+	if f == nil {
+		return s.writeResult(id, errInvalidHandle)
+	}
+	sf, ok := f.(Syncer)
+	if _, has := underlyingFile(f).(Syncer); !ok || !has {
+		return s.writeResponse(id, SSH_FX_OP_UNSUPPORTED, errors.New("UNSUPPORTED fsync@openssh.com"))
+	}
+	return s.writeResult(id, sf.Sync())
+}
+
+// syncOnClose flushes a file handle that was opened for writing before it
+// is closed, see Options.SyncOnClose.
+func (s *session) syncOnClose(handle string) error {
+	o := s.h.getOpenFile(handle)
+	if o == nil || o.flags&(SSH_FXF_WRITE|SSH_FXF_APPEND) == 0 {
+		return nil
+	}
+	f := s.h.GetFile(handle)
+	sf, ok := f.(Syncer)
+	if _, has := underlyingFile(f).(Syncer); !ok || !has {
+		return errors.New("FILE CAN NOT BE SYNCED")
+	}
+	e := sf.Sync()
+	if e != nil || !o.created {
+		return e
+	}
+	ds, ok := s.fs.(DirSyncer)
+	if _, has := underlying(s.fs).(DirSyncer); !ok || !has {
+		return errors.New("DIRECTORY CAN NOT BE SYNCED")
+	}
+	return ds.SyncDir(path.Dir(o.path))
+}
@@ -0,0 +1,24 @@
+// +build linux
+
+package sftpd
+
+import (
+	"os"
+)
+
+func (rf *LocalFile) Sync() error {
+	return rf.file.Sync()
+}
+
+func (fs *LocalFs) SyncDir(path string) error {
+	d, e := fs.openFile(path, os.O_RDONLY, 0)
+	if e != nil {
+		return e
+	}
+	e = d.Sync()
+	ce := d.Close()
+	if e != nil {
+		return e
+	}
+	return ce
+}
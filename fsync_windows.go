@@ -0,0 +1,18 @@
+// +build windows
+
+package sftpd
+
+func (rf *LocalFile) Sync() error {
+	return rf.file.Sync()
+}
+
+// SyncDir does nothing, windows can not flush a directory and NTFS journals
+// directory entries itself.
+func (fs *LocalFs) SyncDir(path string) error {
+	_, release, e := fs.resolve(path, true)
+	if e != nil {
+		return e
+	}
+	release()
+	return nil
+}
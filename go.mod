@@ -8,6 +8,6 @@ require (
 	github.com/taruti/bytepool v0.0.0-20160310082835-5e3a9ea56543
 	github.com/taruti/sshutil v0.0.0-20150618115745-61243369e983
 	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
-	golang.org/x/sys v0.0.0-20200331124033-c3d80250170d // indirect
+	golang.org/x/sys v0.0.0-20200331124033-c3d80250170d
 	golang.org/x/text v0.3.0
 )
@@ -2,65 +2,143 @@ package sftpd
 
 import (
 	"strconv"
+	"sync"
 )
 
+// Handles is the table of open handles of a session. It is safe for
+// concurrent use, copies of an initialized Handles share the same table.
 type Handles struct {
-	f map[string]File
-	d map[string]Dir
-	c int64
+	*handles
+}
+
+type handles struct {
+	mu sync.Mutex
+	f  map[string]File
+	d  map[string]Dir
+	o  map[string]*openFile
+	c  int64
+	// freed are the handles closed since the scheduler last asked, it
+	// forgets their order then.
+	freed []string
+}
+
+// openFile remembers how the server opened a file handle.
+type openFile struct {
+	path    string
+	flags   uint32 // SSH_FXF_* of version 3 and SSH_FXF_TEXT
+	created bool
+	// block are the SSH_FXF_BLOCK_* flags of version 5 and delete tells
+	// that ACE4_DELETE access was asked for, locks holds them under key.
+	block  uint32
+	delete bool
+	key    lockKey
+	locks  *LockManager
+}
+
+// release gives up the blocks and byte range locks of the handle.
+func (o *openFile) release() {
+	if o.locks != nil {
+		o.locks.close(o)
+	}
 }
 
 func (h *Handles) Init() {
-	h.f = map[string]File{}
-	h.d = map[string]Dir{}
+	h.handles = &handles{
+		f: map[string]File{},
+		d: map[string]Dir{},
+		o: map[string]*openFile{},
+	}
 }
 
 func (h *Handles) CloseAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	for _, x := range h.f {
 		x.Close()
 	}
 	for _, x := range h.d {
 		x.Close()
 	}
-
+	for _, o := range h.o {
+		o.release()
+	}
+	h.f = map[string]File{}
+	h.d = map[string]Dir{}
+	h.o = map[string]*openFile{}
 	h.c = 0
 }
 
-func (h *Handles) CloseHandle(k string) {
+// CloseHandle closes the file or directory of handle k and returns the
+// error of its Close. Unknown handles are ignored.
+func (h *Handles) CloseHandle(k string) error {
 	if k == "" {
-		return
+		return nil
 	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var e error
 	if k[0] == 'f' {
 		x, ok := h.f[k]
 		if ok {
-			x.Close()
+			e = x.Close()
+		}
+		if o := h.o[k]; o != nil {
+			o.release()
 		}
 		delete(h.f, k)
+		delete(h.o, k)
 	} else if k[0] == 'd' {
 		x, ok := h.d[k]
 		if ok {
-			x.Close()
+			e = x.Close()
 		}
 		delete(h.d, k)
 	}
+	h.freed = append(h.freed, k)
+	return e
+}
+
+// takeFreed returns the handles closed since the last call.
+func (h *Handles) takeFreed() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	freed := h.freed
+	h.freed = nil
+	return freed
 }
 
 func (h *Handles) Nfiles() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	return len(h.f)
 }
 
 func (h *Handles) Ndir() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	return len(h.d)
 }
 
 func (h *Handles) NewFile(f File) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	h.c++
 	k := "f" + strconv.FormatInt(h.c, 16)
 	h.f[k] = f
 	return k
 }
 
+func (h *Handles) newOpenFile(f File, o *openFile) string {
+	k := h.NewFile(f)
+	h.mu.Lock()
+	h.o[k] = o
+	h.mu.Unlock()
+	return k
+}
+
 func (h *Handles) NewDir(f Dir) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	h.c++
 	k := "d" + strconv.FormatInt(h.c, 16)
 	h.d[k] = f
@@ -68,9 +146,25 @@ func (h *Handles) NewDir(f Dir) string {
 }
 
 func (h *Handles) GetFile(n string) File {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	return h.f[n]
 }
 
+func (h *Handles) getOpenFile(n string) *openFile {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.o[n]
+}
+
+// isText reports whether n is a file opened in text mode.
+func (h *Handles) isText(n string) bool {
+	o := h.getOpenFile(n)
+	return o != nil && o.flags&SSH_FXF_TEXT != 0
+}
+
 func (h *Handles) GetDir(n string) Dir {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	return h.d[n]
-}
\ No newline at end of file
+}
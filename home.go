@@ -0,0 +1,78 @@
+package sftpd
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/taruti/binp"
+)
+
+// homeDir returns the home directory of user, "" is the session user.
+func (s *session) homeDir(user string) (string, error) {
+	if user == "" {
+		return s.opts.HomeDir, nil
+	}
+	if s.opts.UserHomeDir == nil {
+		return "", &os.PathError{Op: "home-directory", Path: "~" + user, Err: os.ErrNotExist}
+	}
+	return s.opts.UserHomeDir(user)
+}
+
+// absPath makes p absolute, relative paths start at the home directory.
+func (s *session) absPath(p string) string {
+	if strings.HasPrefix(p, "/") {
+		return p
+	}
+	return path.Join(s.opts.HomeDir, p)
+}
+
+// expandPath replaces a leading ~ or ~user and makes p absolute.
+func (s *session) expandPath(p string) (string, error) {
+	if !strings.HasPrefix(p, "~") {
+		return s.absPath(p), nil
+	}
+	user, rest := p[1:], ""
+	if i := strings.IndexByte(user, '/'); i >= 0 {
+		user, rest = user[:i], user[i+1:]
+	}
+	home, e := s.homeDir(user)
+	if e != nil {
+		return "", e
+	}
+	return path.Join(home, rest), nil
+}
+
+// homeDirectory serves home-directory.
+func (s *session) homeDirectory(id uint32, p *binp.Parser) error {
+	var user string
+	e := p.B32String(&user).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	home, e := s.homeDir(user)
+	if e == nil && home == "" {
+		e = errors.New("no home directory")
+	}
+	if e == nil {
+		home, e = s.fs.RealPath(home)
+	}
+	return s.writeName(id, home, nil, e)
+}
+
+// expandPathExt serves expand-path@openssh.com.
+func (s *session) expandPathExt(id uint32, p *binp.Parser) error {
+	var name string
+	e := p.B32String(&name).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	name, e = s.expandPath(s.decode(name))
+	if e == nil {
+		name, e = s.fs.RealPath(name)
+	}
+	return s.writeName(id, name, nil, e)
+}
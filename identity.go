@@ -0,0 +1,283 @@
+package sftpd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/taruti/binp"
+)
+
+// IdentityResolver turns owner ids into user and group names, "" means
+// unknown. Options.Identities or a FileSystem implementing it lets clients
+// see owner names, in the long names of version 3, the attributes of
+// version 4 and later and through the users-groups-by-id@openssh.com
+// extension. It must be safe for concurrent use.
+type IdentityResolver interface {
+	UserName(uid uint32) string
+	GroupName(gid uint32) string
+}
+
+// IdentityLookup is implemented by IdentityResolvers that also turn names
+// into ids, for the owners clients of version 4 and later set by name. The
+// resolvers of this package implement it.
+type IdentityLookup interface {
+	UserID(name string) (uint32, bool)
+	GroupID(name string) (uint32, bool)
+}
+
+// DefaultIdentityTTL is how long the resolvers reading /etc/passwd and
+// /etc/group keep what they read when no TTL is given.
+const DefaultIdentityTTL = time.Minute
+
+// resolver returns the IdentityResolver of the session, or nil.
+func (s *session) resolver() IdentityResolver {
+	if s.opts.Identities != nil {
+		return s.opts.Identities
+	}
+	r, _ := underlying(s.fs).(IdentityResolver)
+	return r
+}
+
+// ownerIDs sets the owner ids of attributes a client of version 4 or later
+// sent with owner names. Numeric names are ids already, other names are
+// looked up with the IdentityLookup of the session; a name that can not be
+// resolved fails with SSH_FX_OWNER_INVALID or SSH_FX_GROUP_INVALID rather
+// than leaving the owner unchanged.
+func (s *session) ownerIDs(a *Attr) error {
+	if a.Flags&ATTR_UIDGID != 0 || a.User == "" && a.Group == "" {
+		return nil
+	}
+	lk, _ := s.resolver().(IdentityLookup)
+	uid, ok := lookupID(a.User, lk, IdentityLookup.UserID)
+	if !ok {
+		return NewStatusError(SSH_FX_OWNER_INVALID, "unknown owner "+a.User)
+	}
+	gid, ok := lookupID(a.Group, lk, IdentityLookup.GroupID)
+	if !ok {
+		return NewStatusError(SSH_FX_GROUP_INVALID, "unknown group "+a.Group)
+	}
+	a.Uid, a.Gid = uid, gid
+	a.Flags |= ATTR_UIDGID
+	return nil
+}
+
+func lookupID(name string, lk IdentityLookup, lookup func(IdentityLookup, string) (uint32, bool)) (uint32, bool) {
+	if id, e := strconv.ParseUint(name, 10, 32); e == nil {
+		return uint32(id), true
+	}
+	if lk == nil || name == "" {
+		return 0, false
+	}
+	return lookup(lk, name)
+}
+
+func hasIdentities(s *session) bool {
+	return s.resolver() != nil
+}
+
+// fillNames sets the owner names of a that are not known yet.
+func (s *session) fillNames(a *Attr) {
+	r := s.resolver()
+	if r == nil || a == nil || a.Flags&ATTR_UIDGID == 0 {
+		return
+	}
+	if a.User == "" {
+		a.User = r.UserName(a.Uid)
+	}
+	if a.Group == "" {
+		a.Group = r.GroupName(a.Gid)
+	}
+}
+
+// fileResolver resolves ids with files in the /etc/passwd and /etc/group
+// format, which are read again once they are older than ttl.
+type fileResolver struct {
+	open func(name string) (io.ReadCloser, error)
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	loaded  time.Time
+	reading bool
+	users   map[uint32]string
+	groups  map[uint32]string
+}
+
+func newFileResolver(open func(name string) (io.ReadCloser, error), ttl time.Duration) *fileResolver {
+	if ttl <= 0 {
+		ttl = DefaultIdentityTTL
+	}
+	return &fileResolver{open: open, ttl: ttl}
+}
+
+// NewPasswdResolver returns an IdentityResolver that parses /etc/passwd and
+// /etc/group of the host itself, without cgo or external commands, and
+// reads them again after ttl. ttl <= 0 means DefaultIdentityTTL.
+func NewPasswdResolver(ttl time.Duration) IdentityResolver {
+	return newFileResolver(func(name string) (io.ReadCloser, error) {
+		return os.Open(name)
+	}, ttl)
+}
+
+func (r *fileResolver) UserName(uid uint32) string {
+	users, _ := r.tables()
+	return users[uid]
+}
+
+func (r *fileResolver) GroupName(gid uint32) string {
+	_, groups := r.tables()
+	return groups[gid]
+}
+
+func (r *fileResolver) UserID(name string) (uint32, bool) {
+	users, _ := r.tables()
+	return idOf(users, name)
+}
+
+func (r *fileResolver) GroupID(name string) (uint32, bool) {
+	_, groups := r.tables()
+	return idOf(groups, name)
+}
+
+// idOf returns the smallest id of name in names.
+func idOf(names map[uint32]string, name string) (uint32, bool) {
+	var (
+		id    uint32
+		found bool
+	)
+	for i, n := range names {
+		if n == name && (!found || i < id) {
+			id, found = i, true
+		}
+	}
+	return id, found
+}
+
+// tables returns the users and groups, read again when they are too old.
+// The files are read without holding mu, for sftpFs they come over the
+// upstream connection; lookups meanwhile get the old tables.
+func (r *fileResolver) tables() (map[uint32]string, map[uint32]string) {
+	r.mu.Lock()
+	stale := r.loaded.IsZero() || time.Since(r.loaded) >= r.ttl
+	// 已经有结果时只由一个调用者重新读取
+	if !stale || r.reading && !r.loaded.IsZero() {
+		defer r.mu.Unlock()
+		return r.users, r.groups
+	}
+	r.reading = true
+	r.mu.Unlock()
+
+	users, ue := r.read("/etc/passwd")
+	groups, ge := r.read("/etc/group")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// 读取失败时继续使用之前的结果, 直到下次过期再试
+	if ue == nil {
+		r.users = users
+	}
+	if ge == nil {
+		r.groups = groups
+	}
+	r.loaded = time.Now()
+	r.reading = false
+	return r.users, r.groups
+}
+
+func (r *fileResolver) read(name string) (map[uint32]string, error) {
+	f, e := r.open(name)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	return parseIDFile(f)
+}
+
+// VirtualResolver names owners from fixed tables, for servers whose users
+// do not exist on the host. Ids missing from the tables get User and Group,
+// e.g. the login name of the session, "" leaves them unknown.
+type VirtualResolver struct {
+	Users  map[uint32]string
+	Groups map[uint32]string
+	User   string
+	Group  string
+}
+
+func (r *VirtualResolver) UserName(uid uint32) string {
+	if name, ok := r.Users[uid]; ok {
+		return name
+	}
+	return r.User
+}
+
+func (r *VirtualResolver) GroupName(gid uint32) string {
+	if name, ok := r.Groups[gid]; ok {
+		return name
+	}
+	return r.Group
+}
+
+func (r *VirtualResolver) UserID(name string) (uint32, bool) {
+	return idOf(r.Users, name)
+}
+
+func (r *VirtualResolver) GroupID(name string) (uint32, bool) {
+	return idOf(r.Groups, name)
+}
+
+// parseIDFile reads the name and id columns of an /etc/passwd or
+// /etc/group formatted file, the first entry of an id wins.
+func parseIDFile(rd io.Reader) (map[uint32]string, error) {
+	names := map[uint32]string{}
+	sc := bufio.NewScanner(rd)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 4)
+		if len(fields) < 3 || fields[0] == "" {
+			continue
+		}
+		id, e := strconv.ParseUint(fields[2], 10, 32)
+		if e != nil {
+			continue
+		}
+		if _, ok := names[uint32(id)]; !ok {
+			names[uint32(id)] = fields[0]
+		}
+	}
+	return names, sc.Err()
+}
+
+// usersGroupsByID serves users-groups-by-id@openssh.com.
+func (s *session) usersGroupsByID(id uint32, p *binp.Parser) error {
+	var uids, gids []byte
+	e := p.B32Bytes(&uids).B32Bytes(&gids).End()
+	if e == nil && (len(uids)%4 != 0 || len(gids)%4 != 0) {
+		e = errors.New("id list is not a multiple of 4 bytes")
+	}
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	r := s.resolver()
+	users, groups := binp.Out(), binp.Out()
+	for i := 0; i < len(uids); i += 4 {
+		users.B32String(r.UserName(binary.BigEndian.Uint32(uids[i:])))
+	}
+	for i := 0; i < len(gids); i += 4 {
+		groups.B32String(r.GroupName(binary.BigEndian.Uint32(gids[i:])))
+	}
+	var l binp.Len
+	o := binp.Out().LenB32(&l).LenStart(&l).Byte(SSH_FXP_EXTENDED_REPLY).B32(id)
+	o.B32Bytes(users.Out()).B32Bytes(groups.Out())
+	o.LenDone(&l)
+	return wrc(s.out, o.Out())
+}
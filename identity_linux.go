@@ -0,0 +1,26 @@
+// +build linux
+
+package sftpd
+
+// localIdentities is shared by every LocalFs, they all see the same host.
+var localIdentities = NewPasswdResolver(DefaultIdentityTTL)
+
+// UserName looks uid up in the /etc/passwd of the host.
+func (fs *LocalFs) UserName(uid uint32) string {
+	return localIdentities.UserName(uid)
+}
+
+// GroupName looks gid up in the /etc/group of the host.
+func (fs *LocalFs) GroupName(gid uint32) string {
+	return localIdentities.GroupName(gid)
+}
+
+// UserID looks the user name up in the /etc/passwd of the host.
+func (fs *LocalFs) UserID(name string) (uint32, bool) {
+	return localIdentities.(IdentityLookup).UserID(name)
+}
+
+// GroupID looks the group name up in the /etc/group of the host.
+func (fs *LocalFs) GroupID(name string) (uint32, bool) {
+	return localIdentities.(IdentityLookup).GroupID(name)
+}
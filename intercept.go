@@ -0,0 +1,446 @@
+package sftpd
+
+import (
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Op is the kind of a FileSystem, File or Dir call seen by an Interceptor.
+// The comments tell which fields of Call are arguments and which results.
+type Op int
+
+const (
+	OpOpenFile   Op = iota + 1 // Path, Flags, Attr; File
+	OpOpenDir                  // Path; Dir
+	OpRemove                   // Path
+	OpRename                   // Path, Target (the new name), Flags
+	OpMkdir                    // Path, Attr
+	OpRmdir                    // Path
+	OpStat                     // Path, Flags (the attributes asked for, see AttrStater); Attr
+	OpLStat                    // Path, Flags; Attr
+	OpSetStat                  // Path, Attr
+	OpLSetStat                 // Path, Attr
+	OpReadLink                 // Path; Result
+	OpCreateLink               // Path, Target, Flags
+	OpHardLink                 // Path (the new link), Target (the existing file)
+	OpRealPath                 // Path; Result
+	OpStatVFS                  // Path; StatVFS
+	OpSyncDir                  // Path
+	OpCopyData                 // Path, Offset (destination), Target, SrcOffset (source), Length
+	OpRead                     // Path, Data, Offset; N
+	OpWrite                    // Path, Data, Offset; N
+	OpFStat                    // Path; Attr
+	OpFSetStat                 // Path, Attr
+	OpFStatVFS                 // Path; StatVFS
+	OpSync                     // Path
+	OpCheckFile                // Path, Target (the algorithm), Offset, Length, Flags (the block size); Data
+	OpLock                     // Path, Offset, Length, Flags (SSH_FXF_BLOCK_READ for exclusive locks)
+	OpUnlock                   // Path, Offset, Length
+	OpReaddir                  // Path, Length (the count); Names
+	OpClose                    // Path
+)
+
+var opNames = []string{"", "OpenFile", "OpenDir", "Remove", "Rename", "Mkdir", "Rmdir", "Stat", "LStat",
+	"SetStat", "LSetStat", "ReadLink", "CreateLink", "HardLink", "RealPath", "StatVFS", "SyncDir",
+	"CopyData", "Read", "Write", "FStat", "FSetStat", "FStatVFS", "Sync", "CheckFile", "Lock", "Unlock",
+	"Readdir", "Close"}
+
+func (op Op) String() string {
+	if op > 0 && int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return "Op(" + strconv.Itoa(int(op)) + ")"
+}
+
+// Call is a FileSystem, File or Dir call on its way through the
+// interceptors. File and Dir calls carry the path the handle was opened
+// with.
+type Call struct {
+	Op Op
+	// Conn identifies the user of the session, it is nil when the server
+	// was not told, see Options.Conn.
+	Conn      ssh.ConnMetadata
+	Path      string
+	Target    string
+	Flags     uint32
+	Attr      *Attr
+	Data      []byte
+	Offset    int64
+	SrcOffset int64
+	Length    int64
+
+	// Results.
+	N       int
+	Result  string
+	File    File
+	Dir     Dir
+	Names   []NamedAttr
+	StatVFS *StatVFS
+
+	// 实际执行调用的文件或目录
+	file    File
+	src     File
+	dir     Dir
+	handles Handles
+}
+
+// Invoker carries out a call, it is the next Interceptor of a chain or in
+// the end the FileSystem.
+type Invoker func(c *Call) error
+
+// Interceptor sees every call before it is passed to next and the result
+// afterwards. It may change the arguments of the call or the results, or
+// veto it by returning an error without calling next.
+type Interceptor func(c *Call, next Invoker) error
+
+// Intercept returns a FileSystem that passes every call of fs, and of the
+// files and directories it opens, through the interceptors in order. Calls
+// of the optional interfaces such as HardLinker fail with
+// SSH_FX_OP_UNSUPPORTED when fs does not implement them, after the
+// interceptors have seen them.
+func Intercept(fs FileSystem, conn ssh.ConnMetadata, interceptors ...Interceptor) FileSystem {
+	x := &interceptedFs{fs: fs, conn: conn}
+	x.call = x.invoke
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, next := interceptors[i], x.call
+		x.call = func(c *Call) error { return ic(c, next) }
+	}
+	return x
+}
+
+// underlying returns the FileSystem an intercepted one wraps, so that its
+// optional interfaces can be looked up.
+func underlying(fs FileSystem) FileSystem {
+	if x, ok := fs.(*interceptedFs); ok {
+		return x.fs
+	}
+	return fs
+}
+
+// underlyingFile is underlying for files.
+func underlyingFile(f File) File {
+	if x, ok := f.(*interceptedFile); ok {
+		return x.f
+	}
+	return f
+}
+
+type interceptedFs struct {
+	fs   FileSystem
+	conn ssh.ConnMetadata
+	call Invoker
+}
+
+type interceptedFile struct {
+	x    *interceptedFs
+	f    File
+	path string
+}
+
+type interceptedDir struct {
+	x    *interceptedFs
+	d    Dir
+	path string
+}
+
+func (x *interceptedFs) run(c *Call) error {
+	c.Conn = x.conn
+	return x.call(c)
+}
+
+var errUnsupported = NewStatusError(SSH_FX_OP_UNSUPPORTED, "operation not supported")
+
+// invoke carries out a call on the wrapped FileSystem.
+func (x *interceptedFs) invoke(c *Call) error {
+	var e error
+	switch c.Op {
+	case OpOpenFile:
+		c.File, e = x.fs.OpenFile(c.Path, c.Flags, c.Attr)
+	case OpOpenDir:
+		c.Dir, e = x.fs.OpenDir(c.Path)
+	case OpRemove:
+		e = x.fs.Remove(c.Path)
+	case OpRename:
+		e = x.fs.Rename(c.Path, c.Target, c.Flags)
+	case OpMkdir:
+		e = x.fs.Mkdir(c.Path, c.Attr)
+	case OpRmdir:
+		e = x.fs.Rmdir(c.Path)
+	case OpStat, OpLStat:
+		if sa, ok := x.fs.(AttrStater); ok {
+			c.Attr, e = sa.StatAttrs(c.Path, c.Op == OpLStat, c.Flags)
+		} else {
+			c.Attr, e = x.fs.Stat(c.Path, c.Op == OpLStat)
+		}
+	case OpSetStat:
+		e = x.fs.SetStat(c.Path, c.Attr)
+	case OpReadLink:
+		c.Result, e = x.fs.ReadLink(c.Path)
+	case OpCreateLink:
+		e = x.fs.CreateLink(c.Path, c.Target, c.Flags)
+	case OpRealPath:
+		c.Result, e = x.fs.RealPath(c.Path)
+	case OpLSetStat:
+		e = errUnsupported
+		if ls, ok := x.fs.(LSetStater); ok {
+			e = ls.LSetStat(c.Path, c.Attr)
+		}
+	case OpHardLink:
+		e = errUnsupported
+		if hl, ok := x.fs.(HardLinker); ok {
+			e = hl.HardLink(c.Target, c.Path)
+		}
+	case OpStatVFS:
+		e = errUnsupported
+		if sv, ok := x.fs.(StatVFSer); ok {
+			c.StatVFS, e = sv.StatVFS(c.Path)
+		}
+	case OpSyncDir:
+		e = errUnsupported
+		if ds, ok := x.fs.(DirSyncer); ok {
+			e = ds.SyncDir(c.Path)
+		}
+	case OpCopyData:
+		e = errUnsupported
+		if cp, ok := x.fs.(Copier); ok {
+			e = cp.CopyData(c.file, c.Offset, c.src, c.SrcOffset, c.Length)
+		}
+	case OpRead:
+		c.N, e = c.file.ReadAt(c.Data, c.Offset)
+	case OpWrite:
+		c.N, e = c.file.WriteAt(c.Data, c.Offset)
+	case OpFStat:
+		c.Attr, e = c.file.FStat()
+	case OpFSetStat:
+		e = c.file.FSetStat(c.Attr)
+	case OpFStatVFS:
+		e = errUnsupported
+		if sv, ok := c.file.(FStatVFSer); ok {
+			c.StatVFS, e = sv.FStatVFS()
+		}
+	case OpSync:
+		e = errUnsupported
+		if sf, ok := c.file.(Syncer); ok {
+			e = sf.Sync()
+		}
+	case OpCheckFile:
+		e = errUnsupported
+		if hf, ok := c.file.(Hasher); ok {
+			c.Data, e = hf.CheckFile(c.Target, c.Offset, c.Length, c.Flags)
+		}
+	case OpLock:
+		e = errUnsupported
+		if rl, ok := c.file.(RangeLocker); ok {
+			e = rl.Lock(c.Offset, c.Length, c.Flags&SSH_FXF_BLOCK_READ != 0)
+		}
+	case OpUnlock:
+		e = errUnsupported
+		if rl, ok := c.file.(RangeLocker); ok {
+			e = rl.Unlock(c.Offset, c.Length)
+		}
+	case OpReaddir:
+		c.Names, e = c.dir.Readdir(int(c.Length), c.handles)
+	case OpClose:
+		if c.file != nil {
+			e = c.file.Close()
+		} else {
+			e = c.dir.Close()
+		}
+	default:
+		e = errUnsupported
+	}
+	return e
+}
+
+func (x *interceptedFs) OpenFile(name string, flags uint32, attr *Attr) (File, error) {
+	c := &Call{Op: OpOpenFile, Path: name, Flags: flags, Attr: attr}
+	if e := x.run(c); e != nil {
+		return nil, e
+	}
+	return &interceptedFile{x: x, f: c.File, path: name}, nil
+}
+
+func (x *interceptedFs) OpenDir(name string) (Dir, error) {
+	c := &Call{Op: OpOpenDir, Path: name}
+	if e := x.run(c); e != nil {
+		return nil, e
+	}
+	return &interceptedDir{x: x, d: c.Dir, path: name}, nil
+}
+
+func (x *interceptedFs) Remove(name string) error {
+	return x.run(&Call{Op: OpRemove, Path: name})
+}
+
+func (x *interceptedFs) Rename(old string, new string, flags uint32) error {
+	return x.run(&Call{Op: OpRename, Path: old, Target: new, Flags: flags})
+}
+
+func (x *interceptedFs) Mkdir(name string, attr *Attr) error {
+	return x.run(&Call{Op: OpMkdir, Path: name, Attr: attr})
+}
+
+func (x *interceptedFs) Rmdir(name string) error {
+	return x.run(&Call{Op: OpRmdir, Path: name})
+}
+
+func (x *interceptedFs) Stat(name string, islstat bool) (*Attr, error) {
+	return x.StatAttrs(name, islstat, ^uint32(0))
+}
+
+func (x *interceptedFs) StatAttrs(name string, islstat bool, flags uint32) (*Attr, error) {
+	c := &Call{Op: OpStat, Path: name, Flags: flags}
+	if islstat {
+		c.Op = OpLStat
+	}
+	e := x.run(c)
+	return c.Attr, e
+}
+
+func (x *interceptedFs) SetStat(name string, attr *Attr) error {
+	return x.run(&Call{Op: OpSetStat, Path: name, Attr: attr})
+}
+
+func (x *interceptedFs) ReadLink(path string) (string, error) {
+	c := &Call{Op: OpReadLink, Path: path}
+	e := x.run(c)
+	return c.Result, e
+}
+
+func (x *interceptedFs) CreateLink(path string, target string, flags uint32) error {
+	return x.run(&Call{Op: OpCreateLink, Path: path, Target: target, Flags: flags})
+}
+
+func (x *interceptedFs) RealPath(path string) (string, error) {
+	c := &Call{Op: OpRealPath, Path: path}
+	e := x.run(c)
+	return c.Result, e
+}
+
+func (x *interceptedFs) LSetStat(name string, attr *Attr) error {
+	return x.run(&Call{Op: OpLSetStat, Path: name, Attr: attr})
+}
+
+func (x *interceptedFs) HardLink(oldname, newname string) error {
+	return x.run(&Call{Op: OpHardLink, Path: newname, Target: oldname})
+}
+
+func (x *interceptedFs) StatVFS(path string) (*StatVFS, error) {
+	c := &Call{Op: OpStatVFS, Path: path}
+	e := x.run(c)
+	return c.StatVFS, e
+}
+
+func (x *interceptedFs) SyncDir(path string) error {
+	return x.run(&Call{Op: OpSyncDir, Path: path})
+}
+
+func (x *interceptedFs) CopyData(dst File, dstOffset int64, src File, srcOffset, length int64) error {
+	c := &Call{Op: OpCopyData, Offset: dstOffset, SrcOffset: srcOffset, Length: length,
+		file: underlyingFile(dst), src: underlyingFile(src)}
+	if f, ok := dst.(*interceptedFile); ok {
+		c.Path = f.path
+	}
+	if f, ok := src.(*interceptedFile); ok {
+		c.Target = f.path
+	}
+	return x.run(c)
+}
+
+func (f *interceptedFile) run(c *Call) error {
+	c.Path, c.file = f.path, f.f
+	return f.x.run(c)
+}
+
+func (f *interceptedFile) ReadAt(bs []byte, pos int64) (int, error) {
+	c := &Call{Op: OpRead, Data: bs, Offset: pos}
+	e := f.run(c)
+	return c.N, e
+}
+
+func (f *interceptedFile) WriteAt(bs []byte, pos int64) (int, error) {
+	c := &Call{Op: OpWrite, Data: bs, Offset: pos}
+	e := f.run(c)
+	return c.N, e
+}
+
+func (f *interceptedFile) FStat() (*Attr, error) {
+	c := &Call{Op: OpFStat}
+	e := f.run(c)
+	return c.Attr, e
+}
+
+func (f *interceptedFile) FSetStat(a *Attr) error {
+	return f.run(&Call{Op: OpFSetStat, Attr: a})
+}
+
+func (f *interceptedFile) FStatVFS() (*StatVFS, error) {
+	c := &Call{Op: OpFStatVFS}
+	e := f.run(c)
+	return c.StatVFS, e
+}
+
+func (f *interceptedFile) Sync() error {
+	return f.run(&Call{Op: OpSync})
+}
+
+func (f *interceptedFile) CheckFile(algorithm string, offset, length int64, blockSize uint32) ([]byte, error) {
+	c := &Call{Op: OpCheckFile, Target: algorithm, Offset: offset, Length: length, Flags: blockSize}
+	e := f.run(c)
+	return c.Data, e
+}
+
+func (f *interceptedFile) Lock(offset, length int64, exclusive bool) error {
+	c := &Call{Op: OpLock, Offset: offset, Length: length, Flags: SSH_FXF_BLOCK_WRITE}
+	if exclusive {
+		c.Flags |= SSH_FXF_BLOCK_READ
+	}
+	return f.run(c)
+}
+
+func (f *interceptedFile) Unlock(offset, length int64) error {
+	return f.run(&Call{Op: OpUnlock, Offset: offset, Length: length})
+}
+
+func (f *interceptedFile) Close() error {
+	return f.run(&Call{Op: OpClose})
+}
+
+func (d *interceptedDir) run(c *Call) error {
+	c.Path, c.dir = d.path, d.d
+	return d.x.run(c)
+}
+
+func (d *interceptedDir) Readdir(count int, handles Handles) ([]NamedAttr, error) {
+	c := &Call{Op: OpReaddir, Length: int64(count), handles: handles}
+	e := d.run(c)
+	return c.Names, e
+}
+
+func (d *interceptedDir) Close() error {
+	return d.run(&Call{Op: OpClose})
+}
+
+// checkCall is the first interceptor of every session. It resolves owner
+// names, keeps extended attributes to Options.XattrNamespaces and files opened with
+// SSH_FXF_BLOCK_DELETE from being removed or replaced.
+func (s *session) checkCall(c *Call, next Invoker) error {
+	var e error
+	switch c.Op {
+	case OpOpenFile, OpMkdir, OpSetStat, OpLSetStat, OpFSetStat:
+		if c.Attr != nil {
+			if e = s.ownerIDs(c.Attr); e == nil {
+				e = s.checkXattrs(c.Attr)
+			}
+		}
+	case OpRemove, OpRmdir:
+		e = s.checkDelete(c.Path)
+	case OpRename:
+		e = s.checkDelete(c.Path, c.Target)
+	}
+	if e != nil {
+		return e
+	}
+	return next(c)
+}
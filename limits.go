@@ -0,0 +1,22 @@
+package sftpd
+
+import (
+	"github.com/taruti/binp"
+)
+
+// limits serves limits@openssh.com, clients size their requests after it.
+func (s *session) limits(id uint32, p *binp.Parser) error {
+	e := p.End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	var l binp.Len
+	o := binp.Out().LenB32(&l).LenStart(&l).Byte(SSH_FXP_EXTENDED_REPLY).B32(id)
+	o.B64(uint64(s.opts.MaxPacketLength))
+	o.B64(uint64(s.opts.MaxReadLength))
+	o.B64(uint64(s.opts.MaxWriteLength))
+	o.B64(maxFiles)
+	o.LenDone(&l)
+	return wrc(s.out, o.Out())
+}
@@ -0,0 +1,92 @@
+package sftpd
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/taruti/binp"
+)
+
+// HardLinker is implemented by file systems that can create hard links.
+type HardLinker interface {
+	// HardLink creates newname as a hard link to the existing oldname.
+	HardLink(oldname, newname string) error
+}
+
+func hasHardLink(s *session) bool {
+	_, ok := underlying(s.fs).(HardLinker)
+	return ok
+}
+
+// hardLink serves hardlink@openssh.com.
+func (s *session) hardLink(id uint32, p *binp.Parser) error {
+	var oldName, newName string
+	e := p.B32String(&oldName).B32String(&newName).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	oldName = s.decode(oldName)
+	newName = s.decode(newName)
+	e = s.fs.(HardLinker).HardLink(oldName, newName)
+	return s.writeResult(id, e)
+}
+
+// link serves the version 6 SSH_FXP_LINK.
+func (s *session) link(p *binp.Parser) error {
+	var (
+		id                uint32
+		newLink, existing string
+		symlink           byte
+	)
+	e := p.B32(&id).B32String(&newLink).B32String(&existing).Byte(&symlink).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	newLink = s.decode(newLink)
+	existing = s.decode(existing)
+	if symlink != 0 {
+		return s.writeResult(id, s.fs.CreateLink(newLink, existing, 0))
+	}
+	hl, ok := s.fs.(HardLinker)
+	if !ok || !hasHardLink(s) {
+		return s.writeResponse(id, SSH_FX_OP_UNSUPPORTED, errors.New("UNSUPPORTED HARD SSH_FXP_LINK"))
+	}
+	return s.writeResult(id, hl.HardLink(existing, newLink))
+}
+
+// symlink serves SSH_FXP_SYMLINK. The draft sends linkpath then
+// targetpath, OpenSSH and the clients written against it send them the
+// other way round.
+func (s *session) symlink(p *binp.Parser) error {
+	var (
+		id               uint32
+		first, second    string
+		linkPath, target string
+	)
+	e := p.B32(&id).B32String(&first).B32String(&second).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	if reversedSymlink(s.opts.ClientVersion) {
+		target, linkPath = first, second
+	} else {
+		linkPath, target = first, second
+	}
+	linkPath = s.decode(linkPath)
+	target = s.decode(target)
+	return s.writeResult(id, s.fs.CreateLink(linkPath, target, 0))
+}
+
+// reversedSymlink reports whether a client with the given version banner
+// sends SSH_FXP_SYMLINK arguments in the OpenSSH order. OpenSSH and Go
+// (github.com/pkg/sftp) clients do, and so is a session whose banner is
+// not known (empty) served. Every other client, e.g. PuTTY, WinSCP or
+// FileZilla, is taken to follow the draft.
+func reversedSymlink(clientVersion string) bool {
+	return clientVersion == "" ||
+		strings.Contains(clientVersion, "OpenSSH") ||
+		strings.HasPrefix(clientVersion, "SSH-2.0-Go")
+}
@@ -1,8 +1,12 @@
 package sftpd
 
 import (
+	"errors"
+	"io"
 	"net"
+	"sync"
 
+	"github.com/taruti/binp"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -19,6 +23,27 @@ type Config struct {
 	LogFunc func(v ...interface{})
 	// FileSystem contains the FileSystem used for this server.
 	FileSystem FileSystem
+	// FileSystemFor optionally returns the FileSystem of the user of a
+	// connection instead of FileSystem, e.g. with a root of its own. An
+	// error or a nil FileSystem closes the connection. When the FileSystem
+	// is an io.Closer it is closed after the connection and its sessions
+	// have ended.
+	FileSystemFor func(conn ssh.ConnMetadata, perms *ssh.Permissions) (FileSystem, error)
+	// Options tunes every sftp session served, the zero value gives the defaults.
+	// All connections share Options.Locks, RunServer creates it when nil.
+	Options Options
+	// HomeDir optionally returns the home directory of the user of a
+	// connection, it overrides Options.HomeDir.
+	HomeDir func(conn ssh.ConnMetadata) string
+	// NameCodec optionally returns the file name encoding of the user of a
+	// connection. Otherwise the LANG, LC_CTYPE or LC_ALL environment variable
+	// a client sends selects it, see NameCodecForLocale, falling back to
+	// Options.NameCodec.
+	NameCodec func(conn ssh.ConnMetadata) NameCodec
+	// RecursiveRemove optionally decides per connection whether its user
+	// may remove whole directory trees, it overrides
+	// Options.RecursiveRemove.
+	RecursiveRemove func(conn ssh.ConnMetadata) bool
 
 	readyChan chan error
 	connChan  chan net.Listener
@@ -43,6 +68,10 @@ func (c *Config) RunServer() error {
 }
 
 func runServer(c *Config) error {
+	// 所有连接共用一个锁管理器
+	if c.Options.Locks == nil {
+		c.Options.Locks = NewLockManager()
+	}
 	listener, e := net.Listen("tcp", c.HostPort)
 	c.readyChan <- e
 	close(c.readyChan)
@@ -79,6 +108,62 @@ func doHandleConn(conn net.Conn, config *Config) error {
 	// The incoming Request channel must be serviced.
 	go printDiscardRequests(config, reqs)
 
+	fs := config.FileSystem
+	// closed 之后不再开始新的会话, 等待 sessions 时不会再有 Add
+	var (
+		sessions   sync.WaitGroup
+		sessionsMu sync.Mutex
+		closed     bool
+	)
+	startSession := func() bool {
+		sessionsMu.Lock()
+		defer sessionsMu.Unlock()
+		if closed {
+			return false
+		}
+		sessions.Add(1)
+		return true
+	}
+	if config.FileSystemFor != nil {
+		fs, e = config.FileSystemFor(sc, sc.Permissions)
+		if e != nil {
+			return e
+		}
+		if fs == nil {
+			return errors.New("FileSystemFor returned no file system")
+		}
+		if c, ok := fs.(io.Closer); ok {
+			// 连接断开并且所有会话结束后再释放用户的文件系统
+			defer func() {
+				sc.Close()
+				sessionsMu.Lock()
+				closed = true
+				sessionsMu.Unlock()
+				sessions.Wait()
+				if e := c.Close(); e != nil {
+					config.LogFunc("sftpd closing file system failed:", e)
+				}
+			}()
+		}
+	}
+
+	opts := config.Options
+	opts.ClientVersion = string(sc.ClientVersion())
+	opts.Conn = sc
+	if config.HomeDir != nil {
+		opts.HomeDir = config.HomeDir(sc)
+	}
+	if config.RecursiveRemove != nil {
+		opts.RecursiveRemove = config.RecursiveRemove(sc)
+	}
+	userCodec := false
+	if config.NameCodec != nil {
+		if nc := config.NameCodec(sc); nc != nil {
+			opts.NameCodec = nc
+			userCodec = true
+		}
+	}
+
 	// Service the incoming Channel channel.
 	for newChannel := range chans {
 		if newChannel.ChannelType() != "session" {
@@ -91,17 +176,28 @@ func doHandleConn(conn net.Conn, config *Config) error {
 		}
 
 		go func(in <-chan *ssh.Request) {
+			// 每个会话可以通过环境变量指定自己的文件名编码
+			opts := opts
+			rank := 0
 			for req := range in {
 				ok := false
 				switch {
+				case req.Type == "env" && !userCodec:
+					if nc, r := envNameCodec(req.Payload); nc != nil && r >= rank {
+						opts.NameCodec, rank = nc, r
+						ok = true
+					}
 				case IsSftpRequest(req):
-					ok = true
-					go func() {
-						e := ServeChannel(channel, config.FileSystem, 0)
+					if ok = startSession(); !ok {
+						break
+					}
+					go func(opts Options) {
+						defer sessions.Done()
+						e := ServeChannelWith(channel, fs, &opts)
 						if e != nil {
 							config.LogFunc("sftpd servechannel failed:", e)
 						}
-					}()
+					}(opts)
 				}
 				req.Reply(ok, nil)
 			}
@@ -111,6 +207,20 @@ func doHandleConn(conn net.Conn, config *Config) error {
 	return nil
 }
 
+// envNameCodec returns the codec of a locale environment variable of an
+// "env" request and its precedence, LC_ALL overrides LC_CTYPE and LANG.
+func envNameCodec(payload []byte) (NameCodec, int) {
+	var name, value string
+	if binp.NewParser(payload).B32String(&name).B32String(&value).End() != nil {
+		return nil, 0
+	}
+	rank := map[string]int{"LANG": 1, "LC_CTYPE": 2, "LC_ALL": 3}[name]
+	if rank == 0 {
+		return nil, 0
+	}
+	return NameCodecForLocale(value), rank
+}
+
 func printDiscardRequests(c *Config, in <-chan *ssh.Request) {
 	for req := range in {
 		c.LogFunc("sftpd discarding ssh request", req.Type, *req)
@@ -2,15 +2,13 @@ package sftpd
 // 实现了一个本地可读写的文件系统 FileSystem 接口
 
 import (
-	"errors"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
 )
 
-var sysType = runtime.GOOS
-
 func NewLocalFile(file *os.File) *LocalFile {
 	return &LocalFile{file: file}
 }
@@ -19,6 +17,8 @@ func NewLocalDir(dir *os.File) *LocalDir {
 	return &LocalDir{dir: dir}
 }
 
+// NewLocalFs returns a FileSystem of the host directory root. Every path,
+// symbolic links included, is resolved beneath root and can not leave it.
 func NewLocalFs(root string) *LocalFs {
 	return &LocalFs{root: root}
 }
@@ -45,21 +45,41 @@ func (rf *LocalFile) FStat() (*Attr, error) {
 	if e != nil {
 		return nil, e
 	}
-	if sysType == "linux" {
-		a.FillFrom(fi, 1)
-	} else {
-		a.FillFrom(fi, 0)
+	a.FillFrom(fi)
+	if a.Extended, _ = fileXattrs(rf.file); len(a.Extended) > 0 {
+		a.Flags |= ATTR_EXTENDED
 	}
 	return &a, nil
 }
 
 func (rf *LocalFile) FSetStat(a *Attr) error {
-	e := rf.file.Chmod(a.Mode)
-	if e != nil {
-		return e
+	var e error
+	if a.Flags & ATTR_SIZE != 0 {
+		e = rf.file.Truncate(int64(a.Size))
+		if e != nil {
+			return e
+		}
+	}
+	if a.Flags & ATTR_MODE != 0 {
+		e = rf.file.Chmod(a.Mode)
+		if e != nil {
+			return e
+		}
 	}
-	if sysType != "windows" {	// windows 不支持 chown 操作
+	if a.Flags & ATTR_UIDGID != 0 && runtime.GOOS != "windows" {	// windows 不支持 chown 操作
 		e = rf.file.Chown(int(a.Uid), int(a.Gid))
+		if e != nil {
+			return e
+		}
+	}
+	if a.Flags & ATTR_TIME != 0 {
+		e = fileChtimes(rf.file, a.ATime, a.MTime)
+		if e != nil {
+			return e
+		}
+	}
+	if a.Flags & ATTR_EXTENDED != 0 {
+		e = setFileXattrs(rf.file, a.Extended)
 	}
 	return e
 }
@@ -77,10 +97,10 @@ func (d *LocalDir) Readdir(count int, handles Handles) ([]NamedAttr, error) {
 	for i, fi := range fis {
 		rs[i].Name = fi.Name()
 
-		if sysType == "linux" {
-			rs[i].FillFrom(fi, 1)
-		} else {
-			rs[i].FillFrom(fi, 0)
+		rs[i].FillFrom(fi)
+		rs[i].Nlink = linkCount(fi)
+		if fi.Mode() & os.ModeSymlink != 0 {
+			rs[i].Link, _ = readlinkIn(d.dir, fi.Name())
 		}
 	}
 	return rs, nil
@@ -94,72 +114,41 @@ type LocalFs struct {
 	root string
 }
 
-func (fs *LocalFs) rfsMangle(path string) (string, error) {
-	if strings.Contains(path, "..") {
-		return "<Invalid Path>", errors.New("Invalid Path")
-	}
-	if len(path) > 0 || path[0] == '/' {
-		if len(path) > 1 {
-			path = path[1:]
-		} else {
-			path = ""
-		}
-	}
-
-	if len(path) <= 0 {
-		path = ""
-	} else if len(path) == 1 {
-		if path == "/" || path == "." {
-			path = ""
-		}
-	} else {
-		if path[0] == '/' {
-			path = path[1:]
-		}
-	}
-
-	path = fs.root + path
-	return path, nil
-}
-
 func (fs *LocalFs) Stat(path string, isLstat bool) (*Attr, error) {
-	p, e := fs.rfsMangle(path)
-	if e != nil {
-		return nil, e
-	}
-	var fi os.FileInfo
-	if isLstat {
-		fi, e = os.Lstat(p)
-	} else {
-		fi, e = os.Stat(p)
-	}
+	return fs.StatAttrs(path, isLstat, ^uint32(0))
+}
 
+// StatAttrs is Stat that only reads the extended attributes, which takes
+// opening the file, when flags has ATTR_EXTENDED.
+func (fs *LocalFs) StatAttrs(path string, isLstat bool, flags uint32) (*Attr, error) {
+	fi, e := fs.lstat(path, !isLstat)
 	if e != nil {
 		return nil, e
 	}
 	var a Attr
-	if sysType == "linux" {
-		a.FillFrom(fi, 1)
-	} else {
-		a.FillFrom(fi, 0)
+	a.FillFrom(fi)
+	if flags & ATTR_EXTENDED == 0 {
+		return &a, nil
+	}
+	// 读取不到扩展属性时仍然返回其他属性
+	if a.Extended, _ = fs.pathXattrs(path, !isLstat); len(a.Extended) > 0 {
+		a.Flags |= ATTR_EXTENDED
 	}
 	return &a, nil
 }
 
-func (fs *LocalFs) OpenFile(path string, mode uint32, a *Attr) (File, error) {
-	p, e := fs.rfsMangle(path)
-	if e != nil {
-		return nil, e
-	}
-	var (
-		f *os.File
-		flag int
-	)
-	if mode & SSH_FXF_READ != 0 {
-		flag |= os.O_RDONLY
-	}
-	if mode & SSH_FXF_WRITE != 0 {
-		flag |= os.O_WRONLY
+// openFlags converts the SSH_FXF flags of an open request to os.OpenFile
+// flags.
+func openFlags(mode uint32) int {
+	var flag int
+	// os.O_RDONLY 是 0, 读写同时打开时要用 os.O_RDWR
+	switch {
+	case mode & SSH_FXF_READ != 0 && mode & SSH_FXF_WRITE != 0:
+		flag = os.O_RDWR
+	case mode & SSH_FXF_WRITE != 0:
+		flag = os.O_WRONLY
+	default:
+		flag = os.O_RDONLY
 	}
 	if mode & SSH_FXF_APPEND != 0 {
 		flag |= os.O_APPEND
@@ -173,21 +162,32 @@ func (fs *LocalFs) OpenFile(path string, mode uint32, a *Attr) (File, error) {
 	if mode & SSH_FXF_EXCL != 0 {
 		flag |= os.O_EXCL
 	}
+	return flag
+}
 
-	f, e = os.OpenFile(p, flag, 0644)
+func (fs *LocalFs) OpenFile(path string, mode uint32, a *Attr) (File, error) {
+	// 新建文件使用客户端给出的权限
+	perm := os.FileMode(0644)
+	if a.Flags & ATTR_MODE != 0 {
+		perm = a.Mode.Perm()
+	}
+
+	f, e := fs.openFile(path, openFlags(mode), perm)
 
 	if e != nil {
 		return nil, e
 	}
+	if mode & SSH_FXF_CREAT != 0 && a.Flags & ATTR_EXTENDED != 0 {
+		if e = setFileXattrs(f, a.Extended); e != nil {
+			f.Close()
+			return nil, e
+		}
+	}
 	return NewLocalFile(f), nil
 }
 
 func (fs *LocalFs) OpenDir(path string) (Dir, error) {
-	p, e := fs.rfsMangle(path)
-	if e != nil {
-		return nil, e
-	}
-	d, e := os.Open(p)
+	d, e := fs.openFile(path, os.O_RDONLY, 0)
 	if e != nil {
 		return nil, e
 	}
@@ -195,88 +195,98 @@ func (fs *LocalFs) OpenDir(path string) (Dir, error) {
 }
 
 func (fs *LocalFs) Remove(path string) error {
-	p, e := fs.rfsMangle(path)
-	if e != nil {
-		return e
-	}
-	e = os.Remove(p)
-	return e
+	return fs.remove(path)
 }
 
 func (fs *LocalFs) Rename(oldName, newName string, flag uint32) error {
-	o, e := fs.rfsMangle(oldName)
-	if e != nil {
-		return e
-	}
-	n, e := fs.rfsMangle(newName)
-	if e != nil {
-		return e
-	}
-	return os.Rename(o, n)
+	// 覆盖时 rename(2) 原子地替换已存在的目标
+	return fs.rename(oldName, newName, flag & SSH_FXF_RENAME_OVERWRITE != 0)
 }
 
 func (fs *LocalFs) Mkdir(path string, attr *Attr) error {
-	p, e := fs.rfsMangle(path)
-	if e != nil {
+	perm := os.FileMode(0755)
+	if attr.Flags & ATTR_MODE != 0 {
+		perm = attr.Mode.Perm()
+	}
+	if e := fs.mkdir(path, perm); e != nil {
 		return e
 	}
-	return os.Mkdir(p, attr.Mode)
+	// 其余属性在创建后设置, 权限已经在创建时设置了
+	a := *attr
+	a.Flags &^= ATTR_MODE | ATTR_SIZE
+	if a.Flags == 0 {
+		return nil
+	}
+	return fs.SetStat(path, &a)
 }
 
+// Rmdir removes an empty directory, like the protocol requires it fails on
+// directories with entries and on other files.
 func (fs *LocalFs) Rmdir(path string) error {
-	p, e := fs.rfsMangle(path)
-	if e != nil {
-		return e
-	}
-	e = os.RemoveAll(p)
-	return e
+	return fs.rmdir(path)
 }
 
 func (fs *LocalFs) SetStat(path string, attr *Attr) error {
-	p, e := fs.rfsMangle(path)
-	if e != nil {
-		return e
+	var e error
+	if attr.Flags & ATTR_SIZE != 0 {
+		e = fs.truncate(path, int64(attr.Size))
+		if e != nil {
+			return e
+		}
 	}
 
-	e = os.Chmod(p, attr.Mode)
-	if e != nil {
-		return e
+	if attr.Flags & ATTR_MODE != 0 {
+		e = fs.chmod(path, attr.Mode)
+		if e != nil {
+			return e
+		}
 	}
 
-	// 原则上不修改时间
-	//e = os.Chtimes(p, attr.ATime, attr.MTime)
-	//if e != nil {
-	//	return e
-	//}
-
-	if sysType != "windows" {	// windows 不支持 chown 操作
-		e = os.Chown(p, int(attr.Uid), int(attr.Gid))
+	if attr.Flags & ATTR_UIDGID != 0 && runtime.GOOS != "windows" {	// windows 不支持 chown 操作
+		e = fs.chown(path, int(attr.Uid), int(attr.Gid))
+		if e != nil {
+			return e
+		}
+	}
+	if attr.Flags & ATTR_TIME != 0 {
+		e = fs.utimes(path, attr.ATime, attr.MTime)
+		if e != nil {
+			return e
+		}
+	}
+	if attr.Flags & ATTR_EXTENDED != 0 {
+		e = fs.setPathXattrs(path, true, attr.Extended)
 	}
 	return e
 }
 
 func (fs *LocalFs) ReadLink(path string) (string, error) {
-	p, e := fs.rfsMangle(path)
-	if e != nil {
-		return "", e
-	}
-	link, e := os.Readlink(p)
+	link, e := fs.readlink(path)
 	if e != nil {
 		return "", e
 	}
 	return link, nil
 }
 
-func (fs *LocalFs) CreateLink(path string, target string, flags uint32) error {
-	p, e := fs.rfsMangle(path)
-	if e != nil {
-		return e
+// CreateLink creates path as a symbolic link to target. The link is
+// stored relative to its directory, so it resolves to the same place
+// beneath the root whatever the root is and can not point outside of it.
+func (fs *LocalFs) CreateLink(pathX string, target string, flags uint32) error {
+	dir := path.Dir(path.Clean("/" + pathX))
+	// 相对路径相对于链接所在目录, Clean 之后不会超出根目录
+	if !strings.HasPrefix(target, "/") {
+		target = path.Join(dir, target)
 	}
-	t, e := fs.rfsMangle(target)
+	t, e := filepath.Rel(filepath.FromSlash(dir), filepath.FromSlash(path.Clean(target)))
 	if e != nil {
 		return e
 	}
-	return os.Symlink(p, t)
+	return fs.symlink(t, pathX)
+}
+
+func (fs *LocalFs) HardLink(oldName, newName string) error {
+	// 硬链接会让根目录外的文件出现在根目录内, 两边的目录都在根目录下解析
+	return fs.link(oldName, newName)
 }
 
 func (fs *LocalFs) RealPath(pathX string) (string, error) {
@@ -0,0 +1,198 @@
+// +build linux
+
+package sftpd
+
+import (
+	"os"
+	"path"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// LocalFs 在 Linux 上通过根目录下解析得到的目录描述符和 *at 系统调用操作文件,
+// 不依赖 /proc
+
+// sysFchmodat2 is the number of fchmodat2(2), the same on all architectures.
+const sysFchmodat2 = 452
+
+// statInfo is the os.FileInfo of an fstatat(2) result.
+type statInfo struct {
+	name string
+	st   unix.Stat_t
+}
+
+func (fi *statInfo) Name() string       { return fi.name }
+func (fi *statInfo) Size() int64        { return fi.st.Size }
+func (fi *statInfo) Mode() os.FileMode  { return sftpToFileMode(uint32(fi.st.Mode)) }
+func (fi *statInfo) ModTime() time.Time { return time.Unix(fi.st.Mtim.Unix()) }
+func (fi *statInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *statInfo) Sys() interface{}   { return &fi.st }
+
+func (fs *LocalFs) lstat(p string, follow bool) (os.FileInfo, error) {
+	fi := &statInfo{name: path.Base(path.Clean("/" + p))}
+	op := "lstat"
+	if follow {
+		op = "stat"
+	}
+	e := fs.at(op, p, follow, func(dir int, name string) error {
+		// 跟随的链接已经在解析时处理了, 这里不再跟随
+		return unix.Fstatat(dir, name, &fi.st, unix.AT_SYMLINK_NOFOLLOW)
+	})
+	if e != nil {
+		return nil, e
+	}
+	return fi, nil
+}
+
+// remove removes a file or an empty directory like os.Remove.
+func (fs *LocalFs) remove(p string) error {
+	return fs.at("remove", p, false, func(dir int, name string) error {
+		e := unix.Unlinkat(dir, name, 0)
+		if e == nil {
+			return nil
+		}
+		// 不是目录时报告 unlink 的错误
+		if e1 := unix.Unlinkat(dir, name, unix.AT_REMOVEDIR); e1 != unix.ENOTDIR {
+			e = e1
+		}
+		return e
+	})
+}
+
+func (fs *LocalFs) rmdir(p string) error {
+	return fs.at("rmdir", p, false, func(dir int, name string) error {
+		return unix.Unlinkat(dir, name, unix.AT_REMOVEDIR)
+	})
+}
+
+func (fs *LocalFs) rename(o, n string, overwrite bool) error {
+	odir, oname, e := fs.entry(o, false)
+	if e != nil {
+		return &os.LinkError{Op: "rename", Old: o, New: n, Err: e}
+	}
+	defer unix.Close(odir)
+	ndir, nname, e := fs.entry(n, false)
+	if e != nil {
+		return &os.LinkError{Op: "rename", Old: o, New: n, Err: e}
+	}
+	defer unix.Close(ndir)
+	if overwrite {
+		e = unix.Renameat(odir, oname, ndir, nname)
+	} else {
+		e = renameNoReplace(odir, oname, ndir, nname)
+	}
+	if e != nil {
+		return &os.LinkError{Op: "rename", Old: o, New: n, Err: e}
+	}
+	return nil
+}
+
+func (fs *LocalFs) mkdir(p string, perm os.FileMode) error {
+	return fs.at("mkdir", p, false, func(dir int, name string) error {
+		return unix.Mkdirat(dir, name, uint32(perm.Perm()))
+	})
+}
+
+// truncate changes the size of p through a descriptor, there is no *at
+// call for it.
+func (fs *LocalFs) truncate(p string, size int64) error {
+	// O_NONBLOCK 使没有读者的 FIFO 不会阻塞
+	f, e := fs.openFile(p, os.O_WRONLY|unix.O_NONBLOCK|unix.O_NOCTTY, 0)
+	if e != nil {
+		return e
+	}
+	e = f.Truncate(size)
+	ce := f.Close()
+	if e != nil {
+		return e
+	}
+	return ce
+}
+
+func (fs *LocalFs) chmod(p string, mode os.FileMode) error {
+	return fs.at("chmod", p, true, func(dir int, name string) error {
+		return fchmodat(dir, name, fileModeToSftp(mode)&07777)
+	})
+}
+
+func (fs *LocalFs) chown(p string, uid, gid int) error {
+	return fs.at("chown", p, true, func(dir int, name string) error {
+		return unix.Fchownat(dir, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
+
+// utimes changes the access and modification times of p, a zero time is
+// left unchanged.
+func (fs *LocalFs) utimes(p string, atime, mtime time.Time) error {
+	return fs.at("chtimes", p, true, func(dir int, name string) error {
+		ts := []unix.Timespec{timespecOrOmit(atime), timespecOrOmit(mtime)}
+		return unix.UtimesNanoAt(dir, name, ts, unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
+
+func (fs *LocalFs) readlink(p string) (string, error) {
+	var link string
+	e := fs.at("readlink", p, false, func(dir int, name string) error {
+		var e error
+		link, e = readlinkat(dir, name)
+		return e
+	})
+	return link, e
+}
+
+func (fs *LocalFs) symlink(target, p string) error {
+	return fs.at("symlink", p, false, func(dir int, name string) error {
+		return unix.Symlinkat(target, dir, name)
+	})
+}
+
+func (fs *LocalFs) link(o, n string) error {
+	odir, oname, e := fs.entry(o, false)
+	if e != nil {
+		return &os.LinkError{Op: "link", Old: o, New: n, Err: e}
+	}
+	defer unix.Close(odir)
+	ndir, nname, e := fs.entry(n, false)
+	if e != nil {
+		return &os.LinkError{Op: "link", Old: o, New: n, Err: e}
+	}
+	defer unix.Close(ndir)
+	// 不跟随软链接, 和 link(2) 一样链接软链接本身
+	if e = unix.Linkat(odir, oname, ndir, nname, 0); e != nil {
+		return &os.LinkError{Op: "link", Old: o, New: n, Err: e}
+	}
+	return nil
+}
+
+// fchmodat changes the mode of name in dir without following a symbolic
+// link there. Kernels without fchmodat2 can only do that through an open
+// descriptor, which needs read or write permission on the file.
+func fchmodat(dir int, name string, mode uint32) error {
+	bp, e := unix.BytePtrFromString(name)
+	if e != nil {
+		return e
+	}
+	_, _, errno := unix.Syscall6(sysFchmodat2, uintptr(dir), uintptr(unsafe.Pointer(bp)),
+		uintptr(mode), unix.AT_SYMLINK_NOFOLLOW, 0, 0)
+	if errno != unix.ENOSYS {
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+	for _, flag := range []int{unix.O_RDONLY, unix.O_WRONLY} {
+		fd, e := unix.Openat(dir, name, flag|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+		if e == unix.EACCES && flag == unix.O_RDONLY {
+			continue
+		}
+		if e != nil {
+			return e
+		}
+		e = unix.Fchmod(fd, mode)
+		unix.Close(fd)
+		return e
+	}
+	return unix.EACCES
+}
@@ -0,0 +1,138 @@
+// +build windows
+
+package sftpd
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// LocalFs 在 windows 上通过 resolve 得到的路径操作文件
+
+func (fs *LocalFs) lstat(p string, follow bool) (os.FileInfo, error) {
+	h, release, e := fs.resolve(p, follow)
+	if e != nil {
+		return nil, e
+	}
+	defer release()
+	if follow {
+		return os.Stat(h)
+	}
+	return os.Lstat(h)
+}
+
+func (fs *LocalFs) remove(p string) error {
+	h, release, e := fs.resolve(p, false)
+	if e != nil {
+		return e
+	}
+	defer release()
+	return os.Remove(h)
+}
+
+func (fs *LocalFs) rmdir(p string) error {
+	h, release, e := fs.resolve(p, false)
+	if e != nil {
+		return e
+	}
+	defer release()
+	if e = syscall.Rmdir(h); e != nil {
+		return &os.PathError{Op: "rmdir", Path: p, Err: e}
+	}
+	return nil
+}
+
+func (fs *LocalFs) rename(o, n string, overwrite bool) error {
+	ho, releaseO, e := fs.resolve(o, false)
+	if e != nil {
+		return e
+	}
+	defer releaseO()
+	hn, releaseN, e := fs.resolve(n, false)
+	if e != nil {
+		return e
+	}
+	defer releaseN()
+	if overwrite {
+		return os.Rename(ho, hn)
+	}
+	return renameNoReplace(ho, hn)
+}
+
+func (fs *LocalFs) mkdir(p string, perm os.FileMode) error {
+	h, release, e := fs.resolve(p, false)
+	if e != nil {
+		return e
+	}
+	defer release()
+	return os.Mkdir(h, perm)
+}
+
+func (fs *LocalFs) truncate(p string, size int64) error {
+	h, release, e := fs.resolve(p, true)
+	if e != nil {
+		return e
+	}
+	defer release()
+	return os.Truncate(h, size)
+}
+
+func (fs *LocalFs) chmod(p string, mode os.FileMode) error {
+	h, release, e := fs.resolve(p, true)
+	if e != nil {
+		return e
+	}
+	defer release()
+	return os.Chmod(h, mode)
+}
+
+func (fs *LocalFs) chown(p string, uid, gid int) error {
+	h, release, e := fs.resolve(p, true)
+	if e != nil {
+		return e
+	}
+	defer release()
+	return os.Chown(h, uid, gid)
+}
+
+func (fs *LocalFs) utimes(p string, atime, mtime time.Time) error {
+	h, release, e := fs.resolve(p, true)
+	if e != nil {
+		return e
+	}
+	defer release()
+	return chtimes(h, atime, mtime)
+}
+
+func (fs *LocalFs) readlink(p string) (string, error) {
+	h, release, e := fs.resolve(p, false)
+	if e != nil {
+		return "", e
+	}
+	defer release()
+	return os.Readlink(h)
+}
+
+func (fs *LocalFs) symlink(target, p string) error {
+	h, release, e := fs.resolve(p, false)
+	if e != nil {
+		return e
+	}
+	defer release()
+	return os.Symlink(target, h)
+}
+
+func (fs *LocalFs) link(o, n string) error {
+	ho, releaseO, e := fs.resolve(o, false)
+	if e != nil {
+		return e
+	}
+	defer releaseO()
+	hn, releaseN, e := fs.resolve(n, false)
+	if e != nil {
+		return e
+	}
+	defer releaseN()
+	return os.Link(ho, hn)
+}
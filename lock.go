@@ -0,0 +1,302 @@
+package sftpd
+
+import (
+	"math"
+	"path"
+	"reflect"
+	"sync"
+
+	"github.com/taruti/binp"
+)
+
+// blockModes are the SSH_FXF_BLOCK_* flags that deny access to others.
+const blockModes = SSH_FXF_BLOCK_READ | SSH_FXF_BLOCK_WRITE | SSH_FXF_BLOCK_DELETE
+
+// RangeLocker is implemented by files that can also take byte range locks
+// other programs see, e.g. fcntl locks, see Options.SystemLocks. Length 0
+// means up to the end of the file and beyond.
+type RangeLocker interface {
+	Lock(offset, length int64, exclusive bool) error
+	Unlock(offset, length int64) error
+}
+
+// LockManager keeps the open-time SSH_FXF_BLOCK_* flags and the byte range
+// locks of SSH_FXP_BLOCK for every session that shares it, so that it works
+// for any FileSystem. Files are told apart by the FileSystem and the path
+// they were opened with. It is safe for concurrent use.
+type LockManager struct {
+	mu    sync.Mutex
+	files map[lockKey]*fileLocks
+}
+
+// NewLockManager returns an empty LockManager.
+func NewLockManager() *LockManager {
+	return &LockManager{files: map[lockKey]*fileLocks{}}
+}
+
+type lockKey struct {
+	fs   FileSystem
+	path string
+}
+
+func newLockKey(fs FileSystem, p string) lockKey {
+	// 不可比较的 FileSystem 不能作为 map 的键, 只按路径区分
+	fs = underlying(fs)
+	if fs != nil && !reflect.TypeOf(fs).Comparable() {
+		fs = nil
+	}
+	return lockKey{fs: fs, path: path.Clean("/" + p)}
+}
+
+// fileLocks are the open handles of a file and their byte range locks.
+type fileLocks struct {
+	opens  []*openFile
+	ranges []*rangeLock
+}
+
+type rangeLock struct {
+	owner          *openFile
+	offset, length uint64
+	mask           uint32
+}
+
+// rangeEnd returns the offset after a range, length 0 reaches to the end.
+func rangeEnd(offset, length uint64) uint64 {
+	if length == 0 || offset+length < offset {
+		return math.MaxUint64
+	}
+	return offset + length
+}
+
+func (l *rangeLock) overlaps(offset, length uint64) bool {
+	return l.offset < rangeEnd(offset, length) && offset < rangeEnd(l.offset, l.length)
+}
+
+// denies reports whether the block flags a was opened with deny the access
+// b was opened for. Advisory blocks only deny handles that block as well.
+func denies(a, b *openFile) bool {
+	if a.block&SSH_FXF_BLOCK_ADVISORY != 0 && b.block&blockModes == 0 {
+		return false
+	}
+	return a.block&SSH_FXF_BLOCK_READ != 0 && b.flags&SSH_FXF_READ != 0 ||
+		a.block&SSH_FXF_BLOCK_WRITE != 0 && b.flags&(SSH_FXF_WRITE|SSH_FXF_APPEND) != 0 ||
+		a.block&SSH_FXF_BLOCK_DELETE != 0 && b.delete
+}
+
+// open registers a handle that is about to be opened, it fails when the
+// handle and an open one deny each other.
+func (m *LockManager) open(o *openFile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fl := m.files[o.key]
+	if fl == nil {
+		fl = &fileLocks{}
+		m.files[o.key] = fl
+	}
+	for _, x := range fl.opens {
+		if denies(x, o) || denies(o, x) {
+			return NewStatusError(SSH_FX_LOCK_CONFLICT, "file is blocked by another handle")
+		}
+	}
+	fl.opens = append(fl.opens, o)
+	return nil
+}
+
+// close forgets a handle and releases its byte range locks.
+func (m *LockManager) close(o *openFile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fl := m.files[o.key]
+	if fl == nil {
+		return
+	}
+	for i, x := range fl.opens {
+		if x == o {
+			fl.opens = append(fl.opens[:i], fl.opens[i+1:]...)
+			break
+		}
+	}
+	ranges := fl.ranges[:0]
+	for _, l := range fl.ranges {
+		if l.owner != o {
+			ranges = append(ranges, l)
+		}
+	}
+	fl.ranges = ranges
+	if len(fl.opens) == 0 {
+		delete(m.files, o.key)
+	}
+}
+
+// lock takes a byte range lock for o. Locks that only block writes are
+// shared, locks that also block reads are exclusive.
+func (m *LockManager) lock(o *openFile, offset, length uint64, mask uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fl := m.files[o.key]
+	if fl == nil {
+		return errInvalidHandle
+	}
+	const rw = SSH_FXF_BLOCK_READ | SSH_FXF_BLOCK_WRITE
+	for _, l := range fl.ranges {
+		if l.owner == o || !l.overlaps(offset, length) {
+			continue
+		}
+		if l.mask&rw != 0 && mask&rw != 0 && (l.mask|mask)&SSH_FXF_BLOCK_READ != 0 {
+			return NewStatusError(SSH_FX_BYTE_RANGE_LOCK_CONFLICT, "range is locked by another handle")
+		}
+	}
+	fl.ranges = append(fl.ranges, &rangeLock{owner: o, offset: offset, length: length, mask: mask})
+	return nil
+}
+
+// unlock releases the lock o took on exactly this range.
+func (m *LockManager) unlock(o *openFile, offset, length uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fl := m.files[o.key]; fl != nil {
+		for i, l := range fl.ranges {
+			if l.owner == o && l.offset == offset && l.length == length {
+				fl.ranges = append(fl.ranges[:i], fl.ranges[i+1:]...)
+				return nil
+			}
+		}
+	}
+	return NewStatusError(SSH_FX_NO_MATCHING_BYTE_RANGE_LOCK, "no matching lock")
+}
+
+// check fails when another handle holds a mandatory lock that blocks mode
+// (SSH_FXF_BLOCK_READ or SSH_FXF_BLOCK_WRITE) on a part of the range.
+func (m *LockManager) check(o *openFile, offset, length uint64, mode uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fl := m.files[o.key]
+	if fl == nil {
+		return nil
+	}
+	for _, l := range fl.ranges {
+		if l.owner != o && l.mask&SSH_FXF_BLOCK_ADVISORY == 0 && l.mask&mode != 0 && l.overlaps(offset, length) {
+			return NewStatusError(SSH_FX_BYTE_RANGE_LOCK_CONFLICT, "range is locked by another handle")
+		}
+	}
+	return nil
+}
+
+// deletable fails when a handle was opened with SSH_FXF_BLOCK_DELETE on the
+// file.
+func (m *LockManager) deletable(k lockKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fl := m.files[k]
+	if fl == nil {
+		return nil
+	}
+	for _, o := range fl.opens {
+		if o.block&SSH_FXF_BLOCK_DELETE != 0 && o.block&SSH_FXF_BLOCK_ADVISORY == 0 {
+			return NewStatusError(SSH_FX_LOCK_CONFLICT, "file is blocked against deletion")
+		}
+	}
+	return nil
+}
+
+// checkDelete fails when one of the paths may not be removed or replaced.
+func (s *session) checkDelete(paths ...string) error {
+	for _, p := range paths {
+		if e := s.opts.Locks.deletable(newLockKey(s.fs, p)); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// checkRange fails when a READ (SSH_FXF_BLOCK_READ) or WRITE
+// (SSH_FXF_BLOCK_WRITE) of the range on handle conflicts with a lock.
+func (s *session) checkRange(handle string, offset, length uint64, mode uint32) error {
+	o := s.h.getOpenFile(handle)
+	if o == nil || o.locks == nil {
+		return nil
+	}
+	return o.locks.check(o, offset, length, mode)
+}
+
+// lockPath registers a file the server opens by itself, e.g. for
+// copy-file, as if a handle was opened with flags. It fails when the file
+// is blocked or a part of it is locked against the access.
+func (s *session) lockPath(p string, flags uint32) (*openFile, error) {
+	o := &openFile{path: p, flags: flags, key: newLockKey(s.fs, p), locks: s.opts.Locks}
+	if e := o.locks.open(o); e != nil {
+		return nil, e
+	}
+	mode := uint32(SSH_FXF_BLOCK_READ)
+	if flags&SSH_FXF_WRITE != 0 {
+		mode = SSH_FXF_BLOCK_WRITE
+	}
+	if e := o.locks.check(o, 0, 0, mode); e != nil {
+		o.release()
+		return nil, e
+	}
+	return o, nil
+}
+
+// systemLocker returns f as a RangeLocker when the file behind it is one.
+func systemLocker(f File) (RangeLocker, bool) {
+	rl, ok := f.(RangeLocker)
+	_, has := underlyingFile(f).(RangeLocker)
+	return rl, ok && has
+}
+
+// block serves SSH_FXP_BLOCK of version 6.
+func (s *session) block(id uint32, p *binp.Parser) error {
+	var (
+		handle         string
+		offset, length uint64
+		mask           uint32
+	)
+	e := p.B32String(&handle).B64(&offset).B64(&length).B32(&mask).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	f, o := s.h.GetFile(handle), s.h.getOpenFile(handle)
+	if f == nil || o == nil || o.locks == nil {
+		return s.writeResult(id, errInvalidHandle)
+	}
+	if e = o.locks.lock(o, offset, length, mask); e != nil {
+		return s.writeResult(id, e)
+	}
+	if rl, ok := systemLocker(f); ok && s.opts.SystemLocks && mask&(SSH_FXF_BLOCK_READ|SSH_FXF_BLOCK_WRITE) != 0 {
+		if e = rl.Lock(int64(offset), int64(length), mask&SSH_FXF_BLOCK_READ != 0); e != nil {
+			_ = o.locks.unlock(o, offset, length)
+			if statusCode(e) != SSH_FX_BYTE_RANGE_LOCK_CONFLICT {
+				e = &StatusError{Code: SSH_FX_BYTE_RANGE_LOCK_REFUSED, Err: e}
+			}
+			return s.writeResult(id, e)
+		}
+	}
+	return s.writeResult(id, nil)
+}
+
+// unblock serves SSH_FXP_UNBLOCK of version 6.
+func (s *session) unblock(id uint32, p *binp.Parser) error {
+	var (
+		handle         string
+		offset, length uint64
+	)
+	e := p.B32String(&handle).B64(&offset).B64(&length).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	f, o := s.h.GetFile(handle), s.h.getOpenFile(handle)
+	if f == nil || o == nil || o.locks == nil {
+		return s.writeResult(id, errInvalidHandle)
+	}
+	if e = o.locks.unlock(o, offset, length); e != nil {
+		return s.writeResult(id, e)
+	}
+	if rl, ok := systemLocker(f); ok && s.opts.SystemLocks {
+		// 系统锁可能因为只阻止删除而没有加上, 解锁失败不影响结果
+		_ = rl.Unlock(int64(offset), int64(length))
+	}
+	return s.writeResult(id, nil)
+}
@@ -0,0 +1,31 @@
+// +build linux
+
+package sftpd
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Lock takes an open file description lock, so that locks of different
+// handles conflict even in the same process.
+func (rf *LocalFile) Lock(offset, length int64, exclusive bool) error {
+	lk := unix.Flock_t{Type: unix.F_RDLCK, Whence: 0, Start: offset, Len: length}
+	if exclusive {
+		lk.Type = unix.F_WRLCK
+	}
+	e := unix.FcntlFlock(rf.file.Fd(), unix.F_OFD_SETLK, &lk)
+	if e == unix.EAGAIN || e == unix.EACCES {
+		return &StatusError{Code: SSH_FX_BYTE_RANGE_LOCK_CONFLICT, Err: os.NewSyscallError("fcntl", e)}
+	}
+	if e != nil {
+		return os.NewSyscallError("fcntl", e)
+	}
+	return nil
+}
+
+func (rf *LocalFile) Unlock(offset, length int64) error {
+	lk := unix.Flock_t{Type: unix.F_UNLCK, Whence: 0, Start: offset, Len: length}
+	return os.NewSyscallError("fcntl", unix.FcntlFlock(rf.file.Fd(), unix.F_OFD_SETLK, &lk))
+}
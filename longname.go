@@ -0,0 +1,144 @@
+package sftpd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LongNameFormatter formats the longname of the directory entries in the
+// SSH_FXP_NAME replies of protocol version 3. Clients show it as is and
+// some, e.g. older FileZilla versions, parse it like the output of ls -l.
+// Owner names are filled in by the IdentityResolver of the session before.
+type LongNameFormatter interface {
+	LongName(fi *NamedAttr) string
+}
+
+// englishMonths are the month names of the C locale.
+var englishMonths = [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+
+// LsFormatter formats long names exactly like the sftp-server of OpenSSH,
+// e.g. "-rw-r--r--    1 alice    staff        1234 Jan  2 15:04 name",
+// with " -> target" added for symbolic links. It is the default.
+type LsFormatter struct {
+	// Location is the time zone of the times, nil means time.Local.
+	Location *time.Location
+	// Months are the names of January to December, e.g. "1月" for a
+	// Chinese locale. Empty names mean the abbreviations of the C locale.
+	Months [12]string
+}
+
+func (f LsFormatter) LongName(fi *NamedAttr) string {
+	user, group := ownerNames(fi)
+	// 和 OpenSSH 一样, 用户和组至少占 8 个字符, 名字更长时不截断
+	s := fmt.Sprintf("%s  %3d %-8s %-8s %8d %s %s",
+		fi.ModeString,
+		nlink(fi),
+		user, group,
+		fi.Size,
+		f.timeString(fi.MTime),
+		fi.Name,
+	)
+	if fi.Mode&os.ModeSymlink != 0 && fi.Link != "" {
+		s += " -> " + fi.Link
+	}
+	return s
+}
+
+// timeString formats t like strftime "%b %e %H:%M", or "%b %e  %Y" when t
+// is more than half a year ago or in the future.
+func (f LsFormatter) timeString(t time.Time) string {
+	now := time.Now()
+	t = t.In(location(f.Location))
+	month := f.Months[t.Month()-1]
+	if month == "" {
+		month = englishMonths[t.Month()-1]
+	}
+	if now.Add(-365*24*time.Hour/2).Before(t) && !t.After(now) {
+		return fmt.Sprintf("%s %2d %s", month, t.Day(), t.Format("15:04"))
+	}
+	return fmt.Sprintf("%s %2d  %d", month, t.Day(), t.Year())
+}
+
+// WindowsFormatter formats long names like the dir command of windows, e.g.
+// "2006/01/02  15:04             1,234 name" and "<DIR>" for directories.
+type WindowsFormatter struct {
+	// Location is the time zone of the times, nil means time.Local.
+	Location *time.Location
+	// Layout is the time.Format layout of the date and time, "" means
+	// "2006/01/02  15:04".
+	Layout string
+}
+
+func (f WindowsFormatter) LongName(fi *NamedAttr) string {
+	layout := f.Layout
+	if layout == "" {
+		layout = "2006/01/02  15:04"
+	}
+	t := fi.MTime.In(location(f.Location)).Format(layout)
+	switch {
+	case fi.Mode&os.ModeSymlink != 0:
+		s := t + "    <SYMLINK>      " + fi.Name
+		if fi.Link != "" {
+			s += " [" + fi.Link + "]"
+		}
+		return s
+	case fi.Mode.IsDir():
+		return t + "    <DIR>          " + fi.Name
+	}
+	return fmt.Sprintf("%s %17s %s", t, groupDigits(fi.Size), fi.Name)
+}
+
+// MinimalFormatter uses the plain name as long name, clients then rely on
+// the attributes alone.
+type MinimalFormatter struct{}
+
+func (MinimalFormatter) LongName(fi *NamedAttr) string {
+	return fi.Name
+}
+
+// ownerNames returns the owner names of fi, the ids when they are unknown
+// and "-" when fi has no owner.
+func ownerNames(fi *NamedAttr) (string, string) {
+	if fi.Flags&ATTR_UIDGID == 0 {
+		return "-", "-"
+	}
+	user, group := fi.User, fi.Group
+	if user == "" {
+		user = strconv.FormatUint(uint64(fi.Uid), 10)
+	}
+	if group == "" {
+		group = strconv.FormatUint(uint64(fi.Gid), 10)
+	}
+	return user, group
+}
+
+// nlink returns the link count of fi, 1 when it is unknown.
+func nlink(fi *NamedAttr) uint32 {
+	if fi.Nlink == 0 {
+		return 1
+	}
+	return fi.Nlink
+}
+
+func location(l *time.Location) *time.Location {
+	if l == nil {
+		return time.Local
+	}
+	return l
+}
+
+// groupDigits formats n with a comma between groups of three digits.
+func groupDigits(n uint64) string {
+	s := strconv.FormatUint(n, 10)
+	var b strings.Builder
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,31 @@
+package sftpd
+
+import (
+	"github.com/taruti/binp"
+)
+
+// LSetStater is implemented by file systems that can change the attributes
+// of a symbolic link itself instead of the file it points to.
+type LSetStater interface {
+	LSetStat(name string, attr *Attr) error
+}
+
+func hasLSetStat(s *session) bool {
+	_, ok := underlying(s.fs).(LSetStater)
+	return ok
+}
+
+// lsetstat serves lsetstat@openssh.com.
+func (s *session) lsetstat(id uint32, p *binp.Parser) error {
+	var (
+		path string
+		a    Attr
+	)
+	e := parseAttr(p.B32String(&path), &a, s.version).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	path = s.decode(path)
+	return s.writeResult(id, s.fs.(LSetStater).LSetStat(path, &a))
+}
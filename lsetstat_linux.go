@@ -0,0 +1,55 @@
+// +build linux
+
+package sftpd
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// LSetStat changes owner and times of a symbolic link itself. Linux has no
+// permissions, size or user extended attributes for links, for those it
+// fails like lsetstat of OpenSSH; other files get them applied as usual.
+func (fs *LocalFs) LSetStat(path string, attr *Attr) error {
+	fi, e := fs.lstat(path, false)
+	if e != nil {
+		return e
+	}
+	isLink := fi.Mode()&os.ModeSymlink != 0
+	if attr.Flags&(ATTR_MODE|ATTR_SIZE|ATTR_EXTENDED) != 0 && isLink {
+		return &os.PathError{Op: "lsetstat", Path: path, Err: unix.EOPNOTSUPP}
+	}
+	// truncate 和 chmod 会跟随软链接, 文件若在这之间被换成链接也不会逃出根目录
+	if attr.Flags&ATTR_SIZE != 0 {
+		if e = fs.truncate(path, int64(attr.Size)); e != nil {
+			return e
+		}
+	}
+	if attr.Flags&ATTR_MODE != 0 {
+		if e = fs.chmod(path, attr.Mode); e != nil {
+			return e
+		}
+	}
+	if attr.Flags&ATTR_UIDGID != 0 {
+		e = fs.at("lchown", path, false, func(dir int, name string) error {
+			return unix.Fchownat(dir, name, int(attr.Uid), int(attr.Gid), unix.AT_SYMLINK_NOFOLLOW)
+		})
+		if e != nil {
+			return e
+		}
+	}
+	if attr.Flags&ATTR_TIME != 0 {
+		e = fs.at("lsetstat", path, false, func(dir int, name string) error {
+			ts := []unix.Timespec{timespecOrOmit(attr.ATime), timespecOrOmit(attr.MTime)}
+			return unix.UtimesNanoAt(dir, name, ts, unix.AT_SYMLINK_NOFOLLOW)
+		})
+		if e != nil {
+			return e
+		}
+	}
+	if attr.Flags&ATTR_EXTENDED != 0 {
+		return fs.setPathXattrs(path, false, attr.Extended)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+// +build windows
+
+package sftpd
+
+import (
+	"errors"
+	"os"
+)
+
+// LSetStat refuses to change symbolic links, windows can not change them
+// without following; other files get SetStat.
+func (fs *LocalFs) LSetStat(path string, attr *Attr) error {
+	p, release, e := fs.resolve(path, false)
+	if e != nil {
+		return e
+	}
+	defer release()
+	fi, e := os.Lstat(p)
+	if e != nil {
+		return e
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return &os.PathError{Op: "lsetstat", Path: p, Err: errors.New("not supported for symbolic links")}
+	}
+	return fs.SetStat(path, attr)
+}
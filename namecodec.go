@@ -0,0 +1,125 @@
+package sftpd
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// NameCodec converts file names between the encoding a client uses and the
+// UTF-8 names of the FileSystem. It applies to paths in requests, names,
+// long names, link targets and SSH_FXP_REALPATH replies. Names that can
+// not be converted are passed unchanged.
+type NameCodec interface {
+	// Decode converts a name received from the client to UTF-8.
+	Decode(name string) string
+	// Encode converts a UTF-8 name to the encoding of the client.
+	Encode(name string) string
+}
+
+// Name codecs for common client encodings. NameCodecGB18030 is the default,
+// it keeps names from the client that already are valid UTF-8 so that
+// UTF-8 clients can still upload files. It can not tell such clients apart
+// when sending names though: every name it sends, READDIR and REALPATH
+// included, is converted to GB18030, so a UTF-8 client that sends no LANG
+// sees the file it just uploaded as garbled. Servers with UTF-8 clients set
+// NameCodecUTF8, for all sessions or per user with Config.NameCodec.
+var (
+	NameCodecUTF8     NameCodec = utf8Codec{}
+	NameCodecGB18030  NameCodec = textCodec{enc: simplifiedchinese.GB18030, keepUTF8: true}
+	NameCodecBig5     NameCodec = textCodec{enc: traditionalchinese.Big5}
+	NameCodecShiftJIS NameCodec = textCodec{enc: japanese.ShiftJIS}
+	NameCodecEUCKR    NameCodec = textCodec{enc: korean.EUCKR}
+	NameCodecLatin1   NameCodec = textCodec{enc: charmap.ISO8859_1}
+)
+
+// utf8Codec passes names unchanged.
+type utf8Codec struct{}
+
+func (utf8Codec) Decode(name string) string { return name }
+func (utf8Codec) Encode(name string) string { return name }
+
+// textCodec converts names with an encoding of golang.org/x/text.
+type textCodec struct {
+	enc encoding.Encoding
+	// keepUTF8 does not decode names that are valid UTF-8
+	keepUTF8 bool
+}
+
+func (c textCodec) Decode(name string) string {
+	if isASCII(name) || c.keepUTF8 && utf8.ValidString(name) {
+		return name
+	}
+	// 解码器会把无效的字节替换为 U+FFFD, 这样的文件名不转换
+	r, e := c.enc.NewDecoder().String(name)
+	if e != nil || strings.ContainsRune(r, utf8.RuneError) {
+		return name
+	}
+	return r
+}
+
+func (c textCodec) Encode(name string) string {
+	if isASCII(name) || !utf8.ValidString(name) {
+		return name
+	}
+	r, e := c.enc.NewEncoder().String(name)
+	if e != nil {
+		return name
+	}
+	return r
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// NameCodecForLocale returns the codec for the charset of a locale such as
+// "zh_CN.GBK" from the LANG, LC_CTYPE or LC_ALL environment variable of a
+// client, or nil when the charset is unknown.
+func NameCodecForLocale(locale string) NameCodec {
+	i := strings.IndexByte(locale, '.')
+	if i < 0 {
+		return nil
+	}
+	charset := locale[i+1:]
+	if j := strings.IndexByte(charset, '@'); j >= 0 {
+		charset = charset[:j]
+	}
+	charset = strings.Replace(strings.Replace(strings.ToLower(charset), "-", "", -1), "_", "", -1)
+	switch charset {
+	case "utf8":
+		return NameCodecUTF8
+	case "gb18030", "gbk", "gb2312", "euccn", "cp936":
+		return NameCodecGB18030
+	case "big5", "big5hkscs", "cp950":
+		return NameCodecBig5
+	case "sjis", "shiftjis", "cp932":
+		return NameCodecShiftJIS
+	case "euckr", "cp949":
+		return NameCodecEUCKR
+	case "iso88591", "latin1":
+		return NameCodecLatin1
+	}
+	return nil
+}
+
+// decode converts a name received from the client to UTF-8.
+func (s *session) decode(name string) string {
+	return s.opts.NameCodec.Decode(name)
+}
+
+// encode converts a UTF-8 name for the client.
+func (s *session) encode(name string) string {
+	return s.opts.NameCodec.Encode(name)
+}
@@ -0,0 +1,145 @@
+package sftpd
+
+import (
+	"path"
+
+	"github.com/taruti/bytepool"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultWorkers is the number of requests a session processes
+// concurrently when Options.Workers is not set.
+const DefaultWorkers = 16
+
+// DefaultMaxPacketLength is the largest request accepted when
+// Options.MaxPacketLength is not set, the same as OpenSSH.
+const DefaultMaxPacketLength = 256 * 1024
+
+// DefaultXattrNamespaces are the extended attribute namespaces clients may
+// use when Options.XattrNamespaces is nil.
+var DefaultXattrNamespaces = []string{"user."}
+
+// packetOverhead is what a READ reply or a WRITE request needs besides the
+// data, with room for long handles.
+const packetOverhead = 1024
+
+// minPacketLength is the smallest packet every implementation has to
+// accept according to the protocol.
+const minPacketLength = 34000
+
+// Options tunes how ServeChannelWith serves a session.
+// The zero value gives the defaults.
+type Options struct {
+	// Workers is the maximum number of requests of one session that are
+	// processed concurrently. Requests on the same handle still complete
+	// in the order the protocol requires.
+	Workers int
+	// MaxVersion is the highest sftp protocol version offered to clients,
+	// between MinVersion and MaxVersion. Defaults to MaxVersion.
+	MaxVersion int
+	// SyncOnClose makes SSH_FXP_CLOSE of a file opened for writing flush it
+	// to stable storage, and the parent directory of a newly created file,
+	// before the close is acknowledged. It needs a File implementing Syncer
+	// and a FileSystem implementing DirSyncer.
+	SyncOnClose bool
+	// MaxPacketLength is the largest request accepted, between 34000 bytes
+	// and 8 MiB. Longer requests get an error reply. Defaults to
+	// DefaultMaxPacketLength.
+	MaxPacketLength int
+	// MaxReadLength caps the data of a single SSH_FXP_READ reply.
+	// Defaults to MaxPacketLength less 1024 bytes, which is also the
+	// maximum.
+	MaxReadLength int
+	// MaxWriteLength is the largest data of a single SSH_FXP_WRITE.
+	// Defaults to MaxPacketLength less 1024 bytes, which is also the
+	// maximum.
+	MaxWriteLength int
+	// HomeDir is the home directory of the session user, relative paths in
+	// SSH_FXP_REALPATH start there. Defaults to "/".
+	HomeDir string
+	// UserHomeDir optionally returns the home directory of other users for
+	// the home-directory and expand-path@openssh.com extensions.
+	UserHomeDir func(user string) (string, error)
+	// ClientVersion is the SSH version banner of the client, e.g.
+	// "SSH-2.0-OpenSSH_8.2". It tells in which order the client sends the
+	// arguments of SSH_FXP_SYMLINK, unset means the OpenSSH order.
+	ClientVersion string
+	// XattrNamespaces are the prefixes of the extended attributes clients
+	// may read and set through SSH_FILEXFER_ATTR_EXTENDED, nil means
+	// DefaultXattrNamespaces and an empty list none.
+	XattrNamespaces []string
+	// Locks keeps the SSH_FXF_BLOCK_* flags of open handles and the byte
+	// range locks of SSH_FXP_BLOCK. Sessions only see the locks of each
+	// other when they share it, nil gives every session its own.
+	Locks *LockManager
+	// SystemLocks makes SSH_FXP_BLOCK also lock files implementing
+	// RangeLocker, e.g. with fcntl for LocalFs on linux, so that other
+	// programs see the locks.
+	SystemLocks bool
+	// NameCodec converts the file names of clients of protocol version 3,
+	// newer versions always use UTF-8. Defaults to NameCodecGB18030.
+	NameCodec NameCodec
+	// Interceptors see every FileSystem, File and Dir call of the session
+	// in order, after the checks of the server itself, see Intercept.
+	Interceptors []Interceptor
+	// Conn identifies the user of the session to the interceptors.
+	Conn ssh.ConnMetadata
+	// RecursiveRemove announces and serves rmdir-recursive@sftpd, which
+	// removes a directory with everything in it. SSH_FXP_RMDIR only removes
+	// empty directories.
+	RecursiveRemove bool
+	// Identities names the owners of files for clients, e.g. a
+	// VirtualResolver. nil uses the FileSystem when it implements
+	// IdentityResolver, otherwise owners are only shown by number.
+	Identities IdentityResolver
+	// LongNameFormatter formats the long names of directory entries for
+	// clients of protocol version 3. Defaults to LsFormatter, the format of
+	// OpenSSH in local time.
+	LongNameFormatter LongNameFormatter
+}
+
+func (o *Options) withDefaults() Options {
+	var r Options
+	if o != nil {
+		r = *o
+	}
+	if r.Workers <= 0 {
+		r.Workers = DefaultWorkers
+	}
+	if r.MaxVersion < MinVersion || r.MaxVersion > MaxVersion {
+		r.MaxVersion = MaxVersion
+	}
+	if r.MaxPacketLength <= 0 {
+		r.MaxPacketLength = DefaultMaxPacketLength
+	}
+	if r.MaxPacketLength < minPacketLength {
+		r.MaxPacketLength = minPacketLength
+	}
+	if r.MaxPacketLength > bytepool.MaxSize {
+		r.MaxPacketLength = bytepool.MaxSize
+	}
+	if r.XattrNamespaces == nil {
+		r.XattrNamespaces = DefaultXattrNamespaces
+	}
+	if r.NameCodec == nil {
+		r.NameCodec = NameCodecGB18030
+	}
+	if r.LongNameFormatter == nil {
+		r.LongNameFormatter = LsFormatter{}
+	}
+	if r.Locks == nil {
+		r.Locks = NewLockManager()
+	}
+	if r.HomeDir == "" {
+		r.HomeDir = "/"
+	}
+	r.HomeDir = path.Clean("/" + r.HomeDir)
+	max := r.MaxPacketLength - packetOverhead
+	if r.MaxReadLength <= 0 || r.MaxReadLength > max {
+		r.MaxReadLength = max
+	}
+	if r.MaxWriteLength <= 0 || r.MaxWriteLength > max {
+		r.MaxWriteLength = max
+	}
+	return r
+}
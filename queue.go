@@ -0,0 +1,150 @@
+package sftpd
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// barrier keeps the requests that touch the same object in order. Shared
+// requests (reads) run concurrently with each other but never overtake an
+// earlier exclusive one, exclusive requests (writes, close) wait for
+// everything that was received before them.
+type barrier struct {
+	last    chan struct{}
+	readers *sync.WaitGroup
+}
+
+func newBarrier() *barrier {
+	return &barrier{readers: &sync.WaitGroup{}}
+}
+
+// ticket is the place of a single request in a barrier.
+type ticket struct {
+	after   chan struct{}
+	readers *sync.WaitGroup
+	done    chan struct{}
+	shared  *sync.WaitGroup
+	// next is the place of the request in a second barrier.
+	next *ticket
+}
+
+func (b *barrier) enter(exclusive bool) *ticket {
+	t := &ticket{after: b.last}
+	if exclusive {
+		t.readers = b.readers
+		t.done = make(chan struct{})
+		b.last = t.done
+		b.readers = &sync.WaitGroup{}
+	} else {
+		b.readers.Add(1)
+		t.shared = b.readers
+	}
+	return t
+}
+
+// wait blocks until the request may run.
+func (t *ticket) wait() {
+	if t.after != nil {
+		<-t.after
+	}
+	if t.readers != nil {
+		t.readers.Wait()
+	}
+	if t.next != nil {
+		t.next.wait()
+	}
+}
+
+// release lets the requests behind this one proceed.
+func (t *ticket) release() {
+	if t.done != nil {
+		close(t.done)
+	} else {
+		t.shared.Done()
+	}
+	if t.next != nil {
+		t.next.release()
+	}
+}
+
+// scheduler assigns tickets in the order requests are received. Requests
+// on a handle are ordered per handle, path based requests are ordered
+// against each other. It is only used by the reading goroutine.
+type scheduler struct {
+	paths   *barrier
+	handles map[string]*barrier
+	// open tells which handles are text files, their reads are sequential.
+	open Handles
+}
+
+func newScheduler(open Handles) *scheduler {
+	return &scheduler{paths: newBarrier(), handles: map[string]*barrier{}, open: open}
+}
+
+func (s *scheduler) ticket(op byte, bs []byte) *ticket {
+	// READDIR 读到末尾时也会关闭句柄, 不再需要它的顺序
+	for _, k := range s.open.takeFreed() {
+		delete(s.handles, k)
+	}
+	switch op {
+	case SSH_FXP_READ:
+		k := packetHandle(bs)
+		return s.handle(k).enter(s.open.isText(k))
+	case SSH_FXP_FSTAT:
+		return s.handle(packetHandle(bs)).enter(false)
+	case SSH_FXP_WRITE, SSH_FXP_FSETSTAT, SSH_FXP_READDIR, SSH_FXP_BLOCK, SSH_FXP_UNBLOCK:
+		return s.handle(packetHandle(bs)).enter(true)
+	case SSH_FXP_CLOSE:
+		k := packetHandle(bs)
+		t := s.handle(k).enter(true)
+		delete(s.handles, k)
+		return t
+	case SSH_FXP_STAT, SSH_FXP_LSTAT, SSH_FXP_REALPATH, SSH_FXP_READLINK, SSH_FXP_OPENDIR:
+		return s.paths.enter(false)
+	case SSH_FXP_EXTENDED:
+		name, rest := packetString(bs, 4)
+		if x := extensions[name]; x != nil {
+			if x.handle {
+				k, rest := packetString(bs, rest)
+				t := s.handle(k).enter(!x.shared)
+				if x.nextHandle > 0 {
+					if k2, _ := packetString(bs, rest+x.nextHandle); k2 != k {
+						t.next = s.handle(k2).enter(!x.shared)
+					}
+				}
+				return t
+			}
+			return s.paths.enter(!x.shared)
+		}
+	}
+	return s.paths.enter(true)
+}
+
+func (s *scheduler) handle(k string) *barrier {
+	b := s.handles[k]
+	if b == nil {
+		b = newBarrier()
+		s.handles[k] = b
+	}
+	return b
+}
+
+// packetHandle returns the handle string that follows the request id.
+// Malformed packets yield "" and are rejected when they are parsed.
+func packetHandle(bs []byte) string {
+	k, _ := packetString(bs, 4)
+	return k
+}
+
+// packetString returns the string at offset off of a packet and the offset
+// that follows it.
+func packetString(bs []byte, off int) (string, int) {
+	if len(bs) < off+4 {
+		return "", len(bs)
+	}
+	n := binary.BigEndian.Uint32(bs[off:])
+	if uint64(n) > uint64(len(bs)-off-4) {
+		return "", len(bs)
+	}
+	return string(bs[off+4 : off+4+int(n)]), off + 4 + int(n)
+}
@@ -0,0 +1,22 @@
+// +build linux
+
+package sftpd
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// renameNoReplace renames oname in the directory odir to nname in ndir but
+// fails if the target exists.
+func renameNoReplace(odir int, oname string, ndir int, nname string) error {
+	e := unix.Renameat2(odir, oname, ndir, nname, unix.RENAME_NOREPLACE)
+	if e == unix.ENOSYS || e == unix.EINVAL {
+		// 内核或文件系统不支持 RENAME_NOREPLACE
+		var st unix.Stat_t
+		if unix.Fstatat(ndir, nname, &st, unix.AT_SYMLINK_NOFOLLOW) == nil {
+			return unix.EEXIST
+		}
+		return unix.Renameat(odir, oname, ndir, nname)
+	}
+	return e
+}
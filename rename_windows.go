@@ -0,0 +1,26 @@
+// +build windows
+
+package sftpd
+
+import (
+	"os"
+	"syscall"
+)
+
+// renameNoReplace renames o to n but fails if n exists.
+func renameNoReplace(o, n string) error {
+	from, e := syscall.UTF16PtrFromString(o)
+	if e != nil {
+		return e
+	}
+	to, e := syscall.UTF16PtrFromString(n)
+	if e != nil {
+		return e
+	}
+	// MoveFile 不会覆盖已存在的目标
+	e = syscall.MoveFile(from, to)
+	if e != nil {
+		return &os.LinkError{Op: "rename", Old: o, New: n, Err: e}
+	}
+	return nil
+}
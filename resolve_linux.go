@@ -0,0 +1,297 @@
+// +build linux
+
+package sftpd
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysOpenat2 is the number of openat2(2), the same on all architectures.
+const sysOpenat2 = 437
+
+const (
+	resolveNoMagiclinks = 0x02
+	resolveBeneath      = 0x08
+)
+
+// maxSymlinks limits the symbolic links followed in a path like the kernel.
+const maxSymlinks = 40
+
+// openHow is struct open_how of openat2(2).
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+// openat2 opens p relative to dirfd and fails with EXDEV when p or a
+// symbolic link in it leads outside of dirfd.
+func openat2(dirfd int, p string, flags int, mode uint32) (int, error) {
+	bp, e := unix.BytePtrFromString(p)
+	if e != nil {
+		return -1, e
+	}
+	// 不创建文件时 openat2 要求 mode 为 0
+	if flags&(unix.O_CREAT|unix.O_TMPFILE) == 0 {
+		mode = 0
+	}
+	how := openHow{flags: uint64(flags), mode: uint64(mode), resolve: resolveBeneath | resolveNoMagiclinks}
+	fd, _, errno := unix.Syscall6(sysOpenat2, uintptr(dirfd), uintptr(unsafe.Pointer(bp)),
+		uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// tryOpenat2 is openat2, tests replace it to act like a seccomp filter.
+var tryOpenat2 = openat2
+
+// noOpenat2 is set once openat2 turned out to be missing or denied, then
+// paths are resolved beneath the root by walking them.
+var noOpenat2 int32
+
+// openBeneath opens rel beneath the directory root with openat2, or with
+// walkBeneath when the kernel has no openat2 or a seccomp filter denies it.
+func openBeneath(root int, rel string, flags int, mode uint32) (int, error) {
+	if atomic.LoadInt32(&noOpenat2) == 0 {
+		for i := 0; ; i++ {
+			fd, e := tryOpenat2(root, rel, flags, mode)
+			// 并发的 rename 会让 openat2 返回 EAGAIN, 重试几次
+			if e == unix.EAGAIN && i < 16 {
+				continue
+			}
+			if e == unix.EPERM && !openat2Blocked(root) {
+				return fd, e
+			}
+			if e != unix.ENOSYS && e != unix.E2BIG && e != unix.EPERM {
+				return fd, e
+			}
+			// 内核太旧, 没有 openat2 或者不认识 open_how; 容器的 seccomp
+			// 规则对不认识的系统调用返回 EPERM
+			atomic.StoreInt32(&noOpenat2, 1)
+			break
+		}
+	}
+	return walkBeneath(root, rel, flags, mode)
+}
+
+// openat2Blocked tells whether openat2 fails for everything with EPERM,
+// e.g. under a seccomp filter, rather than for one file such as an
+// immutable one opened for writing.
+func openat2Blocked(root int) bool {
+	fd, e := tryOpenat2(root, ".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if e == nil {
+		unix.Close(fd)
+	}
+	return e == unix.EPERM
+}
+
+// walkBeneath opens rel beneath the directory root like openat2 with
+// RESOLVE_BENEATH, see walkEntry. A symbolic link at the end is followed
+// unless flags has O_NOFOLLOW.
+func walkBeneath(root int, rel string, flags int, mode uint32) (int, error) {
+	dir, name, e := walkEntry(root, rel, flags&unix.O_NOFOLLOW == 0)
+	if e != nil {
+		return -1, e
+	}
+	defer unix.Close(dir)
+	// 最后一级在解析之后被换成软链接时不跟随
+	return unix.Openat(dir, name, flags|unix.O_NOFOLLOW, mode)
+}
+
+// walkEntry resolves rel beneath the directory root one component at a time
+// without following symbolic links, which are resolved here instead.
+// Absolute links and ".." above root fail with EXDEV. It returns a
+// descriptor of the directory holding the last component and its name
+// there, "." when rel ends with the directory itself. A symbolic link at
+// the end is resolved as well with follow. The caller closes the
+// descriptor.
+func walkEntry(root int, rel string, follow bool) (int, string, error) {
+	top, e := unix.Openat(root, ".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if e != nil {
+		return -1, "", e
+	}
+	// dirs[0] 是 root, 其余是逐级打开的目录, 遇到 ".." 时回退
+	dirs := []int{top}
+	found := -1
+	defer func() {
+		for _, fd := range dirs {
+			if fd != found {
+				unix.Close(fd)
+			}
+		}
+	}()
+	parts := strings.Split(rel, "/")
+	links := 0
+	for {
+		name := parts[0]
+		parts = parts[1:]
+		last := len(parts) == 0
+		switch name {
+		case "", ".":
+			if !last {
+				continue
+			}
+			// 以目录本身结尾
+			found = dirs[len(dirs)-1]
+			return found, ".", nil
+		case "..":
+			if len(dirs) == 1 {
+				return -1, "", unix.EXDEV
+			}
+			unix.Close(dirs[len(dirs)-1])
+			dirs = dirs[:len(dirs)-1]
+			if last {
+				parts = []string{"."}
+			}
+			continue
+		}
+		dir := dirs[len(dirs)-1]
+		if last && !follow {
+			found = dir
+			return found, name, nil
+		}
+		var st unix.Stat_t
+		e := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if last && (e == unix.ENOENT || e == nil && st.Mode&unix.S_IFMT != unix.S_IFLNK) {
+			// 不存在的最后一级留给调用者创建
+			found = dir
+			return found, name, nil
+		}
+		if e != nil {
+			return -1, "", e
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFLNK {
+			// O_NOFOLLOW 使目录在检查之后被换成软链接时失败
+			fd, e := unix.Openat(dir, name, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			if e != nil {
+				return -1, "", e
+			}
+			dirs = append(dirs, fd)
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return -1, "", unix.ELOOP
+		}
+		target, e := readlinkat(dir, name)
+		if e != nil {
+			return -1, "", e
+		}
+		if strings.HasPrefix(target, "/") {
+			return -1, "", unix.EXDEV
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+}
+
+func readlinkat(dir int, name string) (string, error) {
+	for n := 256; ; n *= 2 {
+		buf := make([]byte, n)
+		l, e := unix.Readlinkat(dir, name, buf)
+		if e != nil {
+			return "", e
+		}
+		if l < n {
+			return string(buf[:l]), nil
+		}
+	}
+}
+
+// readlinkIn reads the symbolic link name in the open directory dir.
+func readlinkIn(dir *os.File, name string) (string, error) {
+	return readlinkat(int(dir.Fd()), name)
+}
+
+// openRoot opens the root directory to resolve paths beneath it.
+func (fs *LocalFs) openRoot() (int, error) {
+	return unix.Open(fs.root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+}
+
+// relPath turns the virtual path p into a path relative to the root.
+func relPath(p string) string {
+	rel := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if rel == "" {
+		rel = "."
+	}
+	return rel
+}
+
+// open opens the virtual path p beneath the root.
+func (fs *LocalFs) open(p string, flags int, mode uint32) (int, error) {
+	root, e := fs.openRoot()
+	if e != nil {
+		return -1, &os.PathError{Op: "open", Path: p, Err: e}
+	}
+	defer unix.Close(root)
+	fd, e := openBeneath(root, relPath(p), flags|unix.O_CLOEXEC, mode)
+	if e == unix.EXDEV {
+		e = os.ErrPermission
+	}
+	if e != nil {
+		return -1, &os.PathError{Op: "open", Path: p, Err: e}
+	}
+	return fd, nil
+}
+
+// openFile opens the virtual path p beneath the root like os.OpenFile.
+func (fs *LocalFs) openFile(p string, flag int, perm os.FileMode) (*os.File, error) {
+	fd, e := fs.open(p, flag|unix.O_LARGEFILE, uint32(perm.Perm()))
+	if e != nil {
+		return nil, e
+	}
+	return os.NewFile(uintptr(fd), p), nil
+}
+
+// entry resolves the virtual path p beneath the root to a descriptor of the
+// directory holding it and its name there, for the *at system calls. With
+// follow a symbolic link at the end is resolved too, otherwise the entry
+// is the link itself. The caller closes the descriptor. Errors are
+// returned as they are, EXDEV of a path leaving the root is
+// os.ErrPermission.
+func (fs *LocalFs) entry(p string, follow bool) (int, string, error) {
+	root, e := fs.openRoot()
+	if e != nil {
+		return -1, "", e
+	}
+	defer unix.Close(root)
+	dirRel, name := path.Split(relPath(p))
+	if dirRel == "" {
+		dirRel = "."
+	}
+	dir, e := openBeneath(root, dirRel, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if e == nil && follow {
+		var st unix.Stat_t
+		if unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW) == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			// 链接的目标可能在别的目录, 从根目录重新逐级解析
+			unix.Close(dir)
+			dir, name, e = walkEntry(root, relPath(p), true)
+		}
+	}
+	if e == unix.EXDEV {
+		e = os.ErrPermission
+	}
+	if e != nil {
+		return -1, "", e
+	}
+	return dir, name, nil
+}
+
+// at runs f with the entry of p and wraps its error in an os.PathError.
+func (fs *LocalFs) at(op, p string, follow bool, f func(dir int, name string) error) error {
+	dir, name, e := fs.entry(p, follow)
+	if e == nil {
+		e = f(dir, name)
+		unix.Close(dir)
+	}
+	if e != nil {
+		return &os.PathError{Op: op, Path: p, Err: e}
+	}
+	return nil
+}
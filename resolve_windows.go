@@ -0,0 +1,65 @@
+// +build windows
+
+package sftpd
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// openFile opens the virtual path p beneath the root like os.OpenFile.
+func (fs *LocalFs) openFile(p string, flag int, perm os.FileMode) (*os.File, error) {
+	host, release, e := fs.resolve(p, flag&os.O_CREATE == 0)
+	if e != nil {
+		return nil, e
+	}
+	defer release()
+	// 创建时只检查了所在目录, 已存在的文件还要检查它本身
+	if _, le := os.Lstat(host); le == nil && flag&os.O_CREATE != 0 {
+		if e = fs.confined(host); e != nil {
+			return nil, e
+		}
+	}
+	return os.OpenFile(host, flag, perm)
+}
+
+// readlinkIn reads the symbolic link name in the open directory dir.
+func readlinkIn(dir *os.File, name string) (string, error) {
+	return os.Readlink(filepath.Join(dir.Name(), name))
+}
+
+// resolve returns a host path for the virtual path p beneath the root.
+// Windows has no openat, the path or with follow unset its directory is
+// checked once links are resolved; this leaves a race with concurrent
+// changes of the tree. release does nothing.
+func (fs *LocalFs) resolve(p string, follow bool) (string, func(), error) {
+	p = path.Clean("/" + p)
+	host := filepath.Join(fs.root, filepath.FromSlash(p))
+	check := host
+	if !follow {
+		check = filepath.Dir(host)
+	}
+	if e := fs.confined(check); e != nil {
+		return "", nil, e
+	}
+	return host, func() {}, nil
+}
+
+// confined checks that p still is beneath the root once symlinks are resolved.
+func (fs *LocalFs) confined(p string) error {
+	root, e := filepath.EvalSymlinks(fs.root)
+	if e != nil {
+		return e
+	}
+	real, e := filepath.EvalSymlinks(p)
+	if e != nil {
+		return e
+	}
+	rel, e := filepath.Rel(root, real)
+	if e != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return &os.PathError{Op: "open", Path: p, Err: os.ErrPermission}
+	}
+	return nil
+}
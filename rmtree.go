@@ -0,0 +1,100 @@
+package sftpd
+
+import (
+	"io"
+	"path"
+
+	"github.com/taruti/binp"
+)
+
+// removeFailure is an entry rmdir-recursive@sftpd could not remove.
+type removeFailure struct {
+	path string
+	err  error
+}
+
+func recursiveRemoveAvailable(s *session) bool {
+	return s.opts.RecursiveRemove
+}
+
+// rmdirRecursive serves rmdir-recursive@sftpd, announced only when
+// Options.RecursiveRemove is set. The request has a directory path, which
+// is removed with everything beneath it; symbolic links are removed, not
+// followed. Entries that fail are skipped and so are the directories above
+// them. The reply is SSH_FX_OK once the whole tree is gone, otherwise an
+// SSH_FXP_EXTENDED_REPLY with a uint32 count followed by the path, uint32
+// status code and message of each failure.
+func (s *session) rmdirRecursive(id uint32, p *binp.Parser) error {
+	var name string
+	e := p.B32String(&name).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	name = s.decode(name)
+	a, e := s.stat(name, true, 0)
+	if e != nil {
+		return s.writeResult(id, e)
+	}
+	if !a.Mode.IsDir() {
+		return s.writeResult(id, NewStatusError(SSH_FX_NOT_A_DIRECTORY, "Not a directory"))
+	}
+	failures := s.removeTree(name, nil)
+	if len(failures) == 0 {
+		return s.writeResult(id, nil)
+	}
+	var l binp.Len
+	o := binp.Out().LenB32(&l).LenStart(&l).Byte(SSH_FXP_EXTENDED_REPLY).B32(id)
+	o.B32(uint32(len(failures)))
+	for _, f := range failures {
+		code := statusCode(f.err)
+		o.B32String(s.encode(f.path)).B32(uint32(downgradeStatus(code, s.version))).B32String(statusMessage(code, f.err))
+	}
+	o.LenDone(&l)
+	return wrc(s.out, o.Out())
+}
+
+// removeTree removes dir and its entries through the FileSystem of the
+// session, so interceptors and delete locks apply to every entry, and
+// appends what it can not remove to failures.
+func (s *session) removeTree(dir string, failures []removeFailure) []removeFailure {
+	d, e := s.fs.OpenDir(dir)
+	if e != nil {
+		return append(failures, removeFailure{dir, e})
+	}
+	// 先读完目录再删除, 边读边删可能漏掉条目
+	var entries []NamedAttr
+	for {
+		fis, e := d.Readdir(1024, s.h)
+		entries = append(entries, fis...)
+		if e == io.EOF || (e == nil && len(fis) == 0) {
+			break
+		}
+		if e != nil {
+			d.Close()
+			return append(failures, removeFailure{dir, e})
+		}
+	}
+	d.Close()
+
+	n := len(failures)
+	for _, fi := range entries {
+		if fi.Name == "." || fi.Name == ".." {
+			continue
+		}
+		p := path.Join(dir, fi.Name)
+		if fi.Mode.IsDir() {
+			failures = s.removeTree(p, failures)
+		} else if e := s.fs.Remove(p); e != nil {
+			failures = append(failures, removeFailure{p, e})
+		}
+	}
+	// 下层有删除失败的条目时目录不为空, 不再报告目录本身
+	if len(failures) > n {
+		return failures
+	}
+	if e := s.fs.Rmdir(dir); e != nil {
+		failures = append(failures, removeFailure{dir, e})
+	}
+	return failures
+}
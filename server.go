@@ -8,500 +8,606 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"time"
+	"sync"
 
 	"github.com/taruti/binp"
 	"github.com/taruti/bytepool"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/text/encoding/simplifiedchinese"
 )
 
 // 前 4 字节表示数据包长度，后 4 字节转成 string 是 sftp
 var sftpSubSystem = []byte{0, 0, 0, 4, 115, 102, 116, 112}
 
-func isGbk(data []byte) bool {
-	length := len(data)
-	var i = 0
-	for i < length {
-		if data[i] <= 0xff {
-			//编码小于等于127,只有一个字节的编码，兼容ASCII吗
-			i++
-			continue
-		} else {
-			//大于127的使用双字节编码
-			if  data[i] >= 0x81 &&
-				data[i] <= 0xfe &&
-				data[i + 1] >= 0x40 &&
-				data[i + 1] <= 0xfe &&
-				data[i + 1] != 0xf7 {
-				i += 2
-				continue
-			} else {
-				return false
-			}
-		}
-	}
-	return true
+// IsSftpRequest checks whether a given ssh.Request is for sftp.
+func IsSftpRequest(req *ssh.Request) bool {
+	//or return req.Type == "subsystem" && (string(req.Payload[4:]) == "sftp")
+	return req.Type == "subsystem" && bytes.Equal(sftpSubSystem, req.Payload)
 }
 
-func preNUm(data byte) int {
-	str := fmt.Sprintf("%b", data)
-	var i = 0
-	for i < len(str) {
-		if str[i] != '1' {
-			break
-		}
-		i++
+// ServeChannel serves a ssh.Channel with the given FileSystem.
+func ServeChannel(c ssh.Channel, fs FileSystem) error {
+	return ServeChannelWith(c, fs, nil)
+}
+
+// ServeChannelWith serves a ssh.Channel with the given FileSystem and Options.
+// Requests are read in order and processed by a pool of workers, replies are
+// sent as soon as they are ready.
+func ServeChannelWith(c ssh.Channel, fs FileSystem, opts *Options) error {
+	defer c.Close()
+	s := &session{
+		c:       c,
+		out:     &syncWriter{w: c},
+		opts:    opts.withDefaults(),
+		newline: canonicalNewline,
 	}
-	return i
+	// 所有文件操作都经过拦截器, 会话自身的检查在最前面
+	s.fs = Intercept(fs, s.opts.Conn, append([]Interceptor{s.checkCall}, s.opts.Interceptors...)...)
+	s.h.Init()
+	defer s.h.CloseAll()
+	return s.serve()
 }
 
-func isUtf8(data []byte) bool {
-	for i := 0; i < len(data);  {
-		if data[i] & 0x80 == 0x00 {
-			// 0XXX_XXXX
-			i++
+// session is the state of one sftp session.
+type session struct {
+	c       ssh.Channel
+	out     io.Writer
+	fs      FileSystem
+	h       Handles
+	opts    Options
+	// version is the negotiated protocol version, it is set by
+	// SSH_FXP_INIT before any other request is dispatched.
+	version uint32
+	// newline is sent for line ends of files opened in text mode.
+	newlineMu sync.Mutex
+	newline   string
+
+	errMu sync.Mutex
+	err   error
+}
+
+// request is a received packet waiting for a worker.
+type request struct {
+	op byte
+	bs []byte
+	t  *ticket
+}
+
+func (s *session) serve() error {
+	brd := bufio.NewReaderSize(s.c, 64 * 1024)
+	sched := newScheduler(s.h)
+	jobs := make(chan *request)
+	var wg sync.WaitGroup
+	workers := 0
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+	for s.failed() == nil {
+		plen, op, e := readPacketHeader(brd)
+		if e != nil {
+			return s.result(e)
+		}
+		plen--
+		debugf("RECEIVED SFTP REQUEST: OP=%s(%d); LEN=%d\n", SSH_FXP(op).String(), SSH_FXP(op), plen)
+		if plen < 2 {
+			debug("SFTP PACKET TOO SHORT")
+			return errors.New("SFTP PACKET TOO SHORT")
+		}
+		if plen > s.opts.MaxPacketLength {
+			debug("SFTP PACKET TOO LONG")
+			if op == SSH_FXP_INIT {
+				return errors.New("SFTP PACKET TOO LONG")
+			}
+			e = s.skipPacket(brd, plen)
+			if e != nil {
+				return s.result(e)
+			}
 			continue
-		} else if num := preNUm(data[i]); num > 2 {
-			// 110X_XXXX 10XX_XXXX
-			// 1110_XXXX 10XX_XXXX 10XX_XXXX
-			// 1111_0XXX 10XX_XXXX 10XX_XXXX 10XX_XXXX
-			// 1111_10XX 10XX_XXXX 10XX_XXXX 10XX_XXXX 10XX_XXXX
-			// 1111_110X 10XX_XXXX 10XX_XXXX 10XX_XXXX 10XX_XXXX 10XX_XXXX
-			// preNUm() 返回首个字节的8个bits中首个0bit前面1bit的个数，该数量也是该字符所使用的字节数
-			i++
-			for j := 0; j < num - 1; j++ {
-				//判断后面的 num - 1 个字节是不是都是10开头
-				if data[i] & 0xc0 != 0x80 {
-					return false
-				}
-				i++
+		}
+		bs := bytepool.Alloc(plen)
+		_, e = io.ReadFull(brd, bs)
+		if e != nil {
+			bytepool.Free(bs)
+			return s.result(e)
+		}
+
+		if op == SSH_FXP_INIT {
+			e = s.init(bs)
+			bytepool.Free(bs)
+			if e != nil {
+				return e
 			}
-		} else  {
-			//其他情况说明不是utf-8
-			return false
+			continue
+		}
+
+		r := &request{op: op, bs: bs, t: sched.ticket(op, bs)}
+		select {
+		case jobs <- r:
+			continue
+		default:
 		}
+		// Start workers lazily, most sessions never need all of them.
+		if workers < s.opts.Workers {
+			workers++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for r := range jobs {
+					s.run(r)
+				}
+			}()
+		}
+		jobs <- r
 	}
-	return true
+	return s.failed()
 }
 
-func gb18030ToUtf8(gb18030 []byte) (utf8 []byte) {
-	if isUtf8(gb18030) {
-		return gb18030
-	} else if isGbk(gb18030) {
-		utf8, err := simplifiedchinese.GB18030.NewDecoder().Bytes(gb18030)
-		if err == nil {
-			return utf8
-		}
-	} else {
-		return gb18030
+func (s *session) run(r *request) {
+	r.t.wait()
+	e := s.handle(r.op, r.bs)
+	r.t.release()
+	bytepool.Free(r.bs)
+	if e != nil {
+		s.fail(e)
 	}
-	return gb18030
 }
 
-func utf8ToGb18030(utf8 []byte) (gb18030 []byte) {
-	if isUtf8(utf8) {
-		gb18030, err := simplifiedchinese.GB18030.NewEncoder().Bytes(utf8)
-		if err == nil {
-			return gb18030
-		}
-	} else if isGbk(utf8) {
-		return utf8
-	} else {
-		return utf8
+// fail records the first fatal error of the session and closes the channel
+// so that the reading goroutine stops.
+func (s *session) fail(e error) {
+	s.errMu.Lock()
+	first := s.err == nil
+	if first {
+		s.err = e
+	}
+	s.errMu.Unlock()
+	if first {
+		s.c.Close()
 	}
-	return utf8
 }
 
-// IsSftpRequest checks whether a given ssh.Request is for sftp.
-func IsSftpRequest(req *ssh.Request) bool {
-	//or return req.Type == "subsystem" && (string(req.Payload[4:]) == "sftp")
-	return req.Type == "subsystem" && bytes.Equal(sftpSubSystem, req.Payload)
+func (s *session) failed() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
 }
 
-var initReply = []byte{0, 0, 0, 5, SSH_FXP_VERSION, 0, 0, 0, 3}
+// result prefers an error reported by a worker over the read error caused by
+// closing the channel.
+func (s *session) result(e error) error {
+	if fe := s.failed(); fe != nil {
+		return fe
+	}
+	return e
+}
 
-// ServeChannel serves a ssh.Channel with the given FileSystem.
-func ServeChannel(c ssh.Channel, fs FileSystem, sysType int) error {
-	// sysType 0 服务器为 windows，1 服务器为 linux，2 后端为 sftp
-	defer c.Close()
-	var h Handles
-	h.Init()
-	defer h.CloseAll()
-	brd := bufio.NewReaderSize(c, 64 * 1024)
+// init negotiates the protocol version. It runs on the reading goroutine,
+// clients wait for SSH_FXP_VERSION before they send other requests. A
+// second SSH_FXP_INIT ends the session.
+func (s *session) init(bs []byte) error {
+	// 会话中途的 INIT 会在工作协程使用时改变版本和属性格式, INIT 没有
+	// 请求 id, 不能回复错误, 只能结束会话
+	if s.version != 0 {
+		return errors.New("SSH_FXP_INIT AFTER THE VERSION WAS NEGOTIATED")
+	}
+	var v uint32
+	if binp.NewParser(bs).B32(&v) == nil {
+		return errors.New("SSH_FXP_INIT TOO SHORT")
+	}
+	s.version = negotiate(v, s.opts.MaxVersion)
+	// 版本 4 以上的文件名都是 utf-8
+	if s.version >= 4 {
+		s.opts.NameCodec = NameCodecUTF8
+	}
+	debugf("CLIENT VERSION %d, USING VERSION %d", v, s.version)
+	return wrc(s.out, versionReply(s.version, s.announcedExtensions()))
+}
+
+// handle processes a single request, a non-nil error ends the session.
+func (s *session) handle(op byte, bs []byte) error {
 	var e error
-	var plen int
-	var op byte
-	var bs []byte
 	var id uint32
-	for {
-		if e == io.EOF {
-			e = writeResponse(c, id, SSH_FX_EOF, nil)
-			if e != nil {
-				return e
-			}
+	c := s.out
+	fs := s.fs
+	h := s.h
+	p := binp.NewParser(bs)
+	switch op {
+	case SSH_FXP_OPEN:
+		var (
+			path string
+			flags uint32
+			a Attr
+		)
+		o := &openFile{locks: s.opts.Locks}
+		p = p.B32(&id).B32String(&path)
+		if s.version >= 5 {
+			var access, v5flags uint32
+			p = p.B32(&access).B32(&v5flags)
+			flags = openFlagsV5(access, v5flags)
+			// SSH_FXF_BLOCK_READ 和 SSH_FXF_TEXT 的值相同, 单独保存
+			o.block = v5flags & (blockModes | SSH_FXF_BLOCK_ADVISORY)
+			o.delete = access&ACE4_DELETE != 0
+		} else {
+			p = p.B32(&flags)
+		}
+		// 版本 3 没有 SSH_FXF_TEXT
+		if s.version < 4 {
+			flags &^= SSH_FXF_TEXT
 		}
-		_ = discard(brd, plen)
-		plen, op, e = readPacketHeader(brd)
+		e = parseAttr(p, &a, s.version).End()
 		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
 			return e
 		}
-		plen--
-		debugf("RECEIVED SFTP REQUEST: OP=%s(%d); LEN=%d\n", SSH_FXP(op).String(), SSH_FXP(op), plen)
-		if plen < 2 {
-			debug("SFTP PACKET TOO SHORT")
-			return errors.New("SFTP PACKET TOO SHORT")
+		if h.Nfiles() >= maxFiles {
+			_ = s.writeResponse(id, SSH_FX_PERMISSION_DENIED, errors.New("TOO MANY OPENED FILES OR PATHS"))
+			return nil
 		}
-
-		// Feeding too large values to peek is ok, it just errors.
-		bs, e = brd.Peek(plen)
+		path = s.decode(path)
+		o.path, o.flags, o.key = path, flags, newLockKey(fs, path)
+		if e = o.locks.open(o); e != nil {
+			return s.writeResult(id, e)
+		}
+		if s.opts.SyncOnClose && flags & SSH_FXF_CREAT != 0 {
+			_, se := s.stat(path, true, 0)
+			o.created = se != nil
+		}
+		var f File
+		f, e = fs.OpenFile(path, flags, &a)
+		if e != nil {
+			o.release()
+			return s.writeResult(id, e)
+		}
+		if flags & SSH_FXF_TEXT != 0 {
+			tf, te := s.openText(f, flags)
+			if te != nil {
+				f.Close()
+				o.release()
+				return s.writeResult(id, te)
+			}
+			f = tf
+		}
+		e = writeHandle(c, id, h.newOpenFile(f, o))
+	case SSH_FXP_CLOSE:
+		var handle string
+		e = p.B32(&id).B32String(&handle).End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+			return e
+		}
+		if s.opts.SyncOnClose {
+			e = s.syncOnClose(handle)
+		}
+		// 关闭失败也要告诉客户端, 例如文本模式的缓冲区或者上游的错误
+		if ce := h.CloseHandle(handle); e == nil {
+			e = ce
+		}
+		e = s.writeResult(id, e)
+	case SSH_FXP_READ:
+		var (
+			handle string
+			offset uint64
+			length uint32
+			n int
+		)
+		e = p.B32(&id).B32String(&handle).B64(&offset).B32(&length).End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+			return e
+		}
+		f := h.GetFile(handle)
+		if f == nil {
+			_ = s.writeResult(id, errInvalidHandle)
+			return nil
+		}
+		if length > uint32(s.opts.MaxReadLength) {
+			length = uint32(s.opts.MaxReadLength)
+		}
+		if e = s.checkRange(handle, offset, uint64(length), SSH_FXF_BLOCK_READ); e != nil {
+			return s.writeResult(id, e)
+		}
+		// The reply header and the data go out in a single write so that
+		// concurrent replies cannot interleave.
+		bs := bytepool.Alloc(4 + 1 + 4 + 4 + int(length))
+		defer bytepool.Free(bs)
+		n, e = f.ReadAt(bs[13:], int64(offset))
+		// Handle go readers that return io.EOF and bytes at the same time.
+		if e == io.EOF && n > 0 {
+			e = nil
+		}
+		if e != nil {
+			return s.writeResult(id, e)
+		}
+		bs = bs[0:13+n]
+		binp.OutWith(bs[:0]).B32(1+4+4+uint32(n)).Byte(SSH_FXP_DATA).B32(id).B32(uint32(n))
+		e = wrc(c, bs)
+	case SSH_FXP_WRITE:
+		var (
+			handle string
+			offset uint64
+			length uint32
+		)
+		p.B32(&id).B32String(&handle).B64(&offset).B32(&length)
+		f := h.GetFile(handle)
+		if f == nil {
+			_ = s.writeResult(id, errInvalidHandle)
+			return nil
+		}
+		var bs []byte
+		e = p.NBytesPeek(int(length), &bs).End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+			return e
+		}
+		if length > uint32(s.opts.MaxWriteLength) {
+			return s.writeResponse(id, SSH_FX_FAILURE, errors.New("WRITE TOO LONG"))
+		}
+		if e = s.checkRange(handle, offset, uint64(length), SSH_FXF_BLOCK_WRITE); e != nil {
+			return s.writeResult(id, e)
+		}
+		_, e = f.WriteAt(bs, int64(offset))
+		e = s.writeResult(id, e)
+	case SSH_FXP_LSTAT, SSH_FXP_STAT:
+		var (
+			path string
+			a *Attr
+		)
+		// 版本 4 以上的客户端告知需要哪些属性, 没有时当作全部
+		want := ^uint32(0)
+		e = optB32(p.B32(&id).B32String(&path), &want).End()
 		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
 			return e
 		}
 
-		p := binp.NewParser(bs)
-		switch op {
-		case SSH_FXP_INIT:
-			e = wrc(c, initReply)
-		case SSH_FXP_OPEN:
-			var (
-				path string
-				flags uint32
-				a Attr
-			)
-			e = parseAttr(p.B32(&id).B32String(&path).B32(&flags), &a).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-			if h.Nfiles() >= maxFiles {
-				_ = writeResponse(c, id, SSH_FX_PERMISSION_DENIED, errors.New("TOO MANY OPENED FILES OR PATHS"))
-				continue
-			}
-			path = string(gb18030ToUtf8([]byte(path)))
-			var f File
-			f, e = fs.OpenFile(path, flags, &a)
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_NO_SUCH_FILE, e) // or SSH_FX_PERMISSION_DENIED
-				continue
-			}
-			e = writeHandle(c, id, h.NewFile(f))
-		case SSH_FXP_CLOSE:
-			var handle string
-			e = p.B32(&id).B32String(&handle).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
+		// 客户端发过来的路径 gb18030 转换为 utf-8
+		path = s.decode(path)
+		a, e = s.stat(path, op == SSH_FXP_LSTAT, want)
+		e = s.writeAttr(id, a, e)
+	case SSH_FXP_FSTAT:
+		var (
+			handle string
+			want uint32
+			a *Attr
+		)
+		e = optB32(p.B32(&id).B32String(&handle), &want).End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+			return e
+		}
+		f := h.GetFile(handle)
+		if f == nil {
+			_ = s.writeResult(id, errInvalidHandle)
+			return nil
+		}
+		a, e = f.FStat()
+		e = s.writeAttr(id, a, e)
+	case SSH_FXP_SETSTAT:
+		var (
+			path string
+			a Attr
+		)
+		e = parseAttr(p.B32(&id).B32String(&path), &a, s.version).End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+			return e
+		}
+		path = s.decode(path)
+		e = fs.SetStat(path, &a)
+		e = s.writeResult(id, e)
+	case SSH_FXP_FSETSTAT:
+		var (
+			handle string
+			a Attr
+		)
+		e = parseAttr(p.B32(&id).B32String(&handle), &a, s.version).End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+			return e
+		}
+		f := h.GetFile(handle)
+		if f == nil {
+			_ = s.writeResult(id, errInvalidHandle)
+			return nil
+		}
+		e = f.FSetStat(&a)
+		e = s.writeResult(id, e)
+	case SSH_FXP_OPENDIR:
+		var (
+			path string
+			dh Dir
+		)
+		e = p.B32(&id).B32String(&path).End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+			return e
+		}
+		path = s.decode(path)
+		dh, e = fs.OpenDir(path)
+		if e != nil {
+			return s.writeResult(id, e)
+		}
+		e = writeHandle(c, id, h.NewDir(dh))
+	case SSH_FXP_READDIR:
+		var handle string
+		e = p.B32(&id).B32String(&handle).End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+			return e
+		}
+		f := h.GetDir(handle)
+		if f == nil {
+			_ = s.writeResult(id, errInvalidHandle)
+			return nil
+		}
+		var fis []NamedAttr
+		fis, e = f.Readdir(1024, h)
+		if e == io.EOF {
 			h.CloseHandle(handle)
-			e = writeResponse(c, id, SSH_FX_OK, nil)
-		case SSH_FXP_READ:
-			var (
-				handle string
-				offset uint64
-				length uint32
-				n int
-			)
-			e = p.B32(&id).B32String(&handle).B64(&offset).B32(&length).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-			f := h.GetFile(handle)
-			if f == nil {
-				_ = writeResponse(c, id, SSH_FX_NO_SUCH_FILE, errors.New("NO SUCH FILE"))
-				continue
-			}
-			if length > 64 * 1024 {
-				length = 64 * 1024
-			}
-			bs := bytepool.Alloc(int(length))
-			n, e = f.ReadAt(bs, int64(offset))
-			// Handle go readers that return io.EOF and bytes at the same time.
-			if e == io.EOF && n > 0 {
-				e = nil
-			}
-			if e != nil {
-				bytepool.Free(bs)
-				continue
-			}
-			bs = bs[0:n]
-			e = wrc(c, binp.Out().B32(1+4+4+uint32(len(bs))).Byte(SSH_FXP_DATA).B32(id).B32(uint32(len(bs))).Out())
-			if e == nil {
-				e = wrc(c, bs)
-			}
-			bytepool.Free(bs)
-		case SSH_FXP_WRITE:
-			var (
-				handle string
-				offset uint64
-				length uint32
-			)
-			p.B32(&id).B32String(&handle).B64(&offset).B32(&length)
-			f := h.GetFile(handle)
-			if f == nil {
-				_ = writeResponse(c, id, SSH_FX_NO_SUCH_FILE, errors.New("NO SUCH FILE"))
-				continue
-			}
-			var bs []byte
-			e = p.NBytesPeek(int(length), &bs).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-			_, e = f.WriteAt(bs, int64(offset))
-			if e != nil {
-				e = writeResponse(c, id, SSH_FX_FAILURE, e)
-			}
-			e = writeResponse(c, id, SSH_FX_OK, nil)
-		case SSH_FXP_LSTAT, SSH_FXP_STAT:
-			var (
-				path string
-				a *Attr
-			)
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-
-			// 客户端发过来的路径 gb18030 转换为 utf-8
-			path = string(gb18030ToUtf8([]byte(path)))
-			a, e = fs.Stat(path, op == SSH_FXP_LSTAT)
-			e = writeAttr(c, id, a, e)
-		case SSH_FXP_FSTAT:
-			var (
-				handle string
-				a *Attr
-			)
-			e = p.B32(&id).B32String(&handle).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-			f := h.GetFile(handle)
-			if f == nil {
-				_ = writeResponse(c, id, SSH_FX_NO_SUCH_FILE, errors.New("NO SUCH FILE"))
-				continue
-			}
-			a, e = f.FStat()
-			e = writeAttr(c, id, a, e)
-		case SSH_FXP_SETSTAT:
-			var (
-				path string
-				a Attr
-			)
-			e = parseAttr(p.B32(&id).B32String(&path), &a).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-			path = string(gb18030ToUtf8([]byte(path)))
-			e = fs.SetStat(path, &a)
-			if e != nil {
-				e = writeResponse(c, id, SSH_FX_FAILURE, e)
-			}
-			e = writeResponse(c, id, SSH_FX_OK, nil)
-		case SSH_FXP_FSETSTAT:
-			var (
-				handle string
-				a Attr
-			)
-			e = parseAttr(p.B32(&id).B32String(&handle), &a).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-			f := h.GetFile(handle)
-			if f == nil {
-				_ = writeResponse(c, id, SSH_FX_NO_SUCH_FILE, errors.New("NO SUCH FILE"))
-				continue
-			}
-			e = f.FSetStat(&a)
-			if e != nil {
-				e = writeResponse(c, id, SSH_FX_FAILURE, e)
-			}
-			e = writeResponse(c, id, SSH_FX_OK, nil)
-		case SSH_FXP_OPENDIR:
-			var (
-				path string
-				dh Dir
-			)
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-			path = string(gb18030ToUtf8([]byte(path)))
-			dh, e = fs.OpenDir(path)
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_NO_SUCH_FILE, errors.New("NO SUCH FILE"))
-				continue
-			}
-			e = writeHandle(c, id, h.NewDir(dh))
-		case SSH_FXP_READDIR:
-			var handle string
-			e = p.B32(&id).B32String(&handle).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-			f := h.GetDir(handle)
-			if f == nil {
-				_ = writeResponse(c, id, SSH_FX_NO_SUCH_FILE, errors.New("NO SUCH FILE"))
-				continue
-			}
-			var fis []NamedAttr
-			fis, e = f.Readdir(1024, h)
-			if e == io.EOF {
-				e = nil
-				_ = writeResponse(c, id, SSH_FX_EOF, nil)
-				h.CloseHandle(handle)
-				continue
-			}
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_FAILURE, e)
-				continue
-			}
-			var l binp.Len
-			o := binp.Out().LenB32(&l).LenStart(&l).Byte(SSH_FXP_NAME).B32(id).B32(uint32(len(fis)))
-			for _, fi := range fis {
-				n := fi.Name
-
-				// 文件名由 utf-8 转换为 gbk 在发送到客户端
-				n = string(utf8ToGb18030([]byte(n)))
+		}
+		if e != nil {
+			return s.writeResult(id, e)
+		}
+		var l binp.Len
+		o := binp.Out().LenB32(&l).LenStart(&l).Byte(SSH_FXP_NAME).B32(id).B32(uint32(len(fis)))
+		for _, fi := range fis {
+			n := fi.Name
 
-				// sftp 协议标准有很多版本 https://wiki.filezilla-project.org/SFTP_specifications
-				// 一般 openssh 使用的是 https://filezilla-project.org/specs/draft-ietf-secsh-filexfer-02.txt
-				// sftp ssh_FXP_NAME 协议中没有规定 longname 格式, 一般类似就是类 unix 系统下使用 ls -l 的结果
+			// 文件名由 utf-8 转换为客户端的编码再发送到客户端
+			n = s.encode(n)
 
-				o.B32String(n).B32String(readdirLongName(&fi, sysType)).B32(fi.Flags)
+			// sftp 协议标准有很多版本 https://wiki.filezilla-project.org/SFTP_specifications
+			// 一般 openssh 使用的是 https://filezilla-project.org/specs/draft-ietf-secsh-filexfer-02.txt
+			// sftp ssh_FXP_NAME 协议中没有规定 longname 格式, 一般类似就是类 unix 系统下使用 ls -l 的结果
 
-				if fi.Flags & ATTR_SIZE != 0 {
-					o.B64(fi.Size)
-				}
-				if fi.Flags & ATTR_UIDGID != 0 {
-					o.B32(fi.Uid).B32(fi.Gid)
-				}
-				if fi.Flags & ATTR_MODE != 0 {
-					o.B32(fileModeToSftp(fi.Mode))
-				}
-				if fi.Flags & ATTR_TIME != 0 {
-					outTimes(o, &fi.Attr)
-				}
-			}
-			o.LenDone(&l)
-			e = wrc(c, o.Out())
-		case SSH_FXP_REMOVE:
-			var path string
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-			path = string(gb18030ToUtf8([]byte(path)))
-			e = fs.Remove(path)
-			if e != nil {
-				e = writeResponse(c, id, SSH_FX_FAILURE, e)
-			}
-			e = writeResponse(c, id, SSH_FX_OK, nil)
-		case SSH_FXP_MKDIR:
-			var (
-				path string
-				a Attr
-			)
-			p = p.B32(&id).B32String(&path)
-			e = parseAttr(p, &a).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-			path = string(gb18030ToUtf8([]byte(path)))
-			e = fs.Mkdir(path, &a)
-			if e != nil {
-				e = writeResponse(c, id, SSH_FX_FAILURE, e)
-			}
-			e = writeResponse(c, id, SSH_FX_OK, nil)
-		case SSH_FXP_RMDIR:
-			var path string
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-			path = string(gb18030ToUtf8([]byte(path)))
-			e = fs.Rmdir(path)
-			if e != nil {
-				e = writeResponse(c, id, SSH_FX_FAILURE, e)
-			}
-			e = writeResponse(c, id, SSH_FX_OK, nil)
-		case SSH_FXP_REALPATH:
-			var path, newpath string
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
-			}
-			path = string(gb18030ToUtf8([]byte(path)))
-			newpath, e = fs.RealPath(path)
-			newpath = string(utf8ToGb18030([]byte(newpath)))
-			e = writeNameOnly(c, id, newpath, e)
-		case SSH_FXP_RENAME:
-			var oldName, newName string
-			var flags uint32
-			_ = p.B32(&id).B32String(&oldName).B32String(&newName).B32(&flags).End()
-			//if e != nil {
-			//	_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-			//	return e
-			//}
-			oldName = string(gb18030ToUtf8([]byte(oldName)))
-			newName = string(gb18030ToUtf8([]byte(newName)))
-			e = fs.Rename(oldName, newName, flags)
-			if e != nil {
-				e = writeResponse(c, id, SSH_FX_FAILURE, e)
-			}
-			e = writeResponse(c, id, SSH_FX_OK, nil)
-		case SSH_FXP_READLINK:
-			var path string
-			e = p.B32(&id).B32String(&path).End()
-			if e != nil {
-				_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, e)
-				return e
+			// 版本 4 及以上没有 longname
+			o.B32String(n)
+			s.fillNames(&fi.Attr)
+			s.filterXattrs(&fi.Attr)
+			if s.version <= 3 {
+				o.B32String(s.encode(s.opts.LongNameFormatter.LongName(&fi)))
+			}
+			outAttr(o, &fi.Attr, s.version)
+		}
+		o.LenDone(&l)
+		e = wrc(c, o.Out())
+	case SSH_FXP_REMOVE:
+		var path string
+		e = p.B32(&id).B32String(&path).End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+			return e
+		}
+		path = s.decode(path)
+		e = fs.Remove(path)
+		e = s.writeResult(id, e)
+	case SSH_FXP_MKDIR:
+		var (
+			path string
+			a Attr
+		)
+		p = p.B32(&id).B32String(&path)
+		e = parseAttr(p, &a, s.version).End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+			return e
+		}
+		path = s.decode(path)
+		e = fs.Mkdir(path, &a)
+		e = s.writeResult(id, e)
+	case SSH_FXP_RMDIR:
+		var path string
+		e = p.B32(&id).B32String(&path).End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+			return e
+		}
+		path = s.decode(path)
+		e = fs.Rmdir(path)
+		e = s.writeResult(id, e)
+	case SSH_FXP_REALPATH:
+		var (
+			path, newpath string
+			control byte
+			a *Attr
+		)
+		p = p.B32(&id).B32String(&path)
+		// 版本 6 可以带 control-byte 和多个 compose-path
+		if s.version >= 6 && p != nil && !p.AtEnd() {
+			p = p.Byte(&control)
+			for p != nil && !p.AtEnd() {
+				var compose string
+				p = p.B32String(&compose)
+				path = composePath(path, compose)
 			}
-			path = string(gb18030ToUtf8([]byte(path)))
-			rpath, e := fs.ReadLink(path)
-			rpath = string(utf8ToGb18030([]byte(rpath)))
-			e = writeNameOnly(c, id, rpath, e)
-		case SSH_FXP_SYMLINK:
-			p.B32(&id)
-			e = writeResponse(c, id, SSH_FX_OP_UNSUPPORTED, errors.New("UNSUPPORTED SSH_FXP_SYMLINK"))
-		case SSH_FXP_EXTENDED:
-			var (
-				extendName string
-				vendorName string
-				productName string
-				productVersion string
-				productBuildNumber uint64
-			)
-			p.B32(&id).B32String(&extendName).B32String(&vendorName).B32String(&productName).B32String(&productVersion).B64(&productBuildNumber)
-			if extendName == "vendor-id" {
-				debugf("CLIENT INFO: %s %s %s %d", vendorName, productName, productVersion, productBuildNumber)
-				e = writeResponse(c, id, SSH_FX_OK, nil)
-			} else {
-				e = writeResponse(c, id, SSH_FX_OP_UNSUPPORTED, errors.New(fmt.Sprintf("UNSUPPORTED SSH_FXP_EXTENDED TYPE: %s", extendName)))
+		}
+		e = p.End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+			return e
+		}
+		path = s.decode(path)
+		newpath, e = fs.RealPath(s.absPath(path))
+		if e == nil && (control == SSH_FXP_REALPATH_STAT_IF || control == SSH_FXP_REALPATH_STAT_ALWAYS) {
+			var se error
+			a, se = s.stat(newpath, false, ^uint32(0))
+			if se != nil && control == SSH_FXP_REALPATH_STAT_ALWAYS {
+				e = se
 			}
-		default:
-			_ = writeResponse(c, id, SSH_FX_BAD_MESSAGE, errors.New("SSH_FX_BAD_MESSAGE"))
+		}
+		e = s.writeName(id, newpath, a, e)
+	case SSH_FXP_RENAME:
+		var oldName, newName string
+		var flags uint32
+		p = p.B32(&id).B32String(&oldName).B32String(&newName)
+		// 版本 5 开始才有 flags
+		if s.version >= 5 {
+			p = p.B32(&flags)
+		}
+		e = p.End()
+		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
 			return e
 		}
+		oldName = s.decode(oldName)
+		newName = s.decode(newName)
+		e = fs.Rename(oldName, newName, flags)
+		e = s.writeResult(id, e)
+	case SSH_FXP_READLINK:
+		var path string
+		e = p.B32(&id).B32String(&path).End()
 		if e != nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
 			return e
 		}
+		path = s.decode(path)
+		rpath, e := fs.ReadLink(path)
+		e = s.writeName(id, rpath, nil, e)
+	case SSH_FXP_SYMLINK:
+		e = s.symlink(p)
+	case SSH_FXP_LINK:
+		e = s.link(p)
+	case SSH_FXP_BLOCK, SSH_FXP_UNBLOCK:
+		p = p.B32(&id)
+		// 版本 6 才有字节范围锁
+		if s.version < 6 {
+			e = s.writeResponse(id, SSH_FX_OP_UNSUPPORTED, fmt.Errorf("UNSUPPORTED %s", SSH_FXP(op)))
+		} else if op == SSH_FXP_BLOCK {
+			e = s.block(id, p)
+		} else {
+			e = s.unblock(id, p)
+		}
+	case SSH_FXP_EXTENDED:
+		e = s.handleExtended(p)
+	default:
+		if p.B32(&id) == nil {
+			_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, errors.New("SSH_FX_BAD_MESSAGE"))
+			return errors.New("SSH_FX_BAD_MESSAGE")
+		}
+		// 不认识的请求也回复一次, 会话继续
+		return s.writeResponse(id, SSH_FX_OP_UNSUPPORTED, fmt.Errorf("unsupported request type %d", op))
 	}
+	return e
 }
 
+
 const maxFiles = 0x100
 
+// skipPacket discards the rest of a request longer than the session
+// accepts and fails it, the session itself goes on.
+func (s *session) skipPacket(rd io.Reader, plen int) error {
+	var bs [4]byte
+	_, e := io.ReadFull(rd, bs[:])
+	if e != nil {
+		return e
+	}
+	_, e = io.CopyN(ioutil.Discard, rd, int64(plen-len(bs)))
+	if e != nil {
+		return e
+	}
+	return s.writeResponse(binary.BigEndian.Uint32(bs[:]), SSH_FX_FAILURE, errors.New("SFTP PACKET TOO LONG"))
+}
+
 func readPacketHeader(rd *bufio.Reader) (int, byte, error) {
 	bs := make([]byte, 5)
 	_, e := io.ReadFull(rd, bs)
@@ -511,122 +617,87 @@ func readPacketHeader(rd *bufio.Reader) (int, byte, error) {
 	return int(binary.BigEndian.Uint32(bs)), bs[4], nil
 }
 
-func parseAttr(p *binp.Parser, a *Attr) *binp.Parser {
-	p = p.B32(&a.Flags)
-	if a.Flags & SSH_FILEXFER_ATTR_SIZE != 0 {
-		p = p.B64(&a.Size)
-	}
-	if a.Flags & SSH_FILEXFER_ATTR_UIDGID != 0 {
-		p = p.B32(&a.Uid).B32(&a.Gid)
-	}
-	if a.Flags & SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
-		var mode uint32
-		p = p.B32(&mode)
-		a.Mode = sftpToFileMode(mode)
-	}
-	if a.Flags & SSH_FILEXFER_ATTR_ACMODTIME != 0 {
-		p = inTimes(p, a)
-	}
-	if a.Flags & SSH_FILEXFER_ATTR_EXTENDED != 0 {
-		var count uint32
-		p = p.B32(&count)
-		if count > 0xFF {
-			return nil
-		}
-		ss := make([]string, 2*int(count))
-		for i := 0; i < int(count); i++ {
-			var k, v string
-			p = p.B32String(&k).B32String(&v)
-			ss[2*i+0] = k
-			ss[2*i+1] = v
-		}
-		a.Extended = ss
-	}
-	return p
-}
-
-func writeAttr(c ssh.Channel, id uint32, a *Attr, e error) error {
+func (s *session) writeAttr(id uint32, a *Attr, e error) error {
 	if e != nil {
-		return writeResponse(c, id, SSH_FX_FAILURE, e)
-	}
-	var l binp.Len
-	o := binp.Out().LenB32(&l).LenStart(&l).Byte(SSH_FXP_ATTRS).B32(id).B32(a.Flags)
-	if a.Flags & SSH_FILEXFER_ATTR_SIZE != 0 {
-		o = o.B64(a.Size)
-	}
-	if a.Flags & SSH_FILEXFER_ATTR_UIDGID != 0 {
-		o = o.B32(a.Uid).B32(a.Gid)
-	}
-	if a.Flags & SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
-		o = o.B32(fileModeToSftp(a.Mode))
+		return s.writeResult(id, e)
 	}
-	if a.Flags & SSH_FILEXFER_ATTR_ACMODTIME != 0 {
-		outTimes(o, a)
-	}
-	if a.Flags & SSH_FILEXFER_ATTR_EXTENDED != 0 {
-		count := uint32(len(a.Extended) / 2)
-		o = o.B32(count)
-		for _, s := range a.Extended {
-			o = o.B32String(s)
-		}
+	if s.version >= 4 {
+		s.fillNames(a)
 	}
+	s.filterXattrs(a)
+	var l binp.Len
+	o := binp.Out().LenB32(&l).LenStart(&l).Byte(SSH_FXP_ATTRS).B32(id)
+	outAttr(o, a, s.version)
 	o.LenDone(&l)
-	return wrc(c, o.Out())
+	return wrc(s.out, o.Out())
 }
 
-func writeNameOnly(c ssh.Channel, id uint32, path string, e error) error {
+// writeName sends a SSH_FXP_NAME with a single entry, a may be nil.
+func (s *session) writeName(id uint32, path string, a *Attr, e error) error {
 	if e != nil {
-		return writeResponse(c, id, SSH_FX_FAILURE, e)
+		return s.writeResult(id, e)
+	}
+	if a == nil {
+		a = &Attr{}
 	}
+	s.filterXattrs(a)
+	path = s.encode(path)
 	var l binp.Len
 	o := binp.Out().LenB32(&l).LenStart(&l).Byte(SSH_FXP_NAME).B32(id).B32(1)
-	o.B32String(path).B32String(path).B32(0)
+	o.B32String(path)
+	if s.version <= 3 {
+		o.B32String(path)
+	}
+	outAttr(o, a, s.version)
 	o.LenDone(&l)
-	return wrc(c, o.Out())
+	return wrc(s.out, o.Out())
 }
 
-func writeResponse(c ssh.Channel, id uint32, code SSH_FX, err error) error {
-	tmpl := []byte{0, 0, 0, 1 + 4 + 4 + 4 + 4, SSH_FXP_STATUS, 0, 0, 0, 0, 0, 0, 0, SSH_FX_OK, 0, 0, 0, 0, 0, 0, 0, 0}
-	bs := make([]byte, len(tmpl))
-	copy(bs, tmpl)
-	binary.BigEndian.PutUint32(bs[5:], id)
-	bs[12] = byte(code)
+// writeResponse sends a SSH_FXP_STATUS, err describes the status to the
+// client. Codes the negotiated version does not know are replaced by older
+// ones.
+func (s *session) writeResponse(id uint32, code SSH_FX, err error) error {
+	code = downgradeStatus(code, s.version)
+	msg := statusMessage(code, err)
 	if err != nil {
 		debugf("SENDING SFTP RESPONSE: SP=%s(%d); ERR: %s\n", code.String(), code, err.Error())
 	} else {
 		debugf("SENDING SFTP RESPONSE: SP=%s(%d); ERR: nil", code.String(), code)
 	}
-	return wrc(c, bs)
+	var l binp.Len
+	o := binp.Out().LenB32(&l).LenStart(&l).Byte(SSH_FXP_STATUS).B32(id).B32(uint32(code))
+	o.B32String(msg).B32String(statusLanguage)
+	o.LenDone(&l)
+	return wrc(s.out, o.Out())
+}
+
+// statusLanguage is the language tag of the status messages.
+const statusLanguage = "en"
+
+// writeResult answers a request that returns no data, the status code is
+// derived from e.
+func (s *session) writeResult(id uint32, e error) error {
+	return s.writeResponse(id, statusCode(e), e)
 }
 
-func writeHandle(c ssh.Channel, id uint32, handle string) error {
+func writeHandle(c io.Writer, id uint32, handle string) error {
 	return wrc(c, binp.OutCap(4+9+len(handle)).B32(uint32(9+len(handle))).B8(SSH_FXP_HANDLE).B32(id).B32String(handle).Out())
 }
 
-func wrc(c ssh.Channel, bs []byte) error {
+func wrc(c io.Writer, bs []byte) error {
 	_, e := c.Write(bs)
 	return e
 }
 
-func discard(brd *bufio.Reader, n int) error {
-	if n == 0 {
-		return nil
-	}
-	m, e := io.Copy(ioutil.Discard, &io.LimitedReader{R: brd, N: int64(n)})
-	if int(m) == n && e == io.EOF {
-		e = nil
-	}
-	return e
+// syncWriter serializes the replies written by concurrent workers, each
+// reply must be written with a single call.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
 }
 
-func outTimes(o *binp.Printer, a *Attr) {
-	o.B32(uint32(a.ATime.Unix())).B32(uint32(a.MTime.Unix()))
+func (w *syncWriter) Write(bs []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(bs)
 }
-
-func inTimes(p *binp.Parser, a *Attr) *binp.Parser {
-	var at, mt uint32
-	p = p.B32(&at).B32(&mt)
-	a.ATime = time.Unix(int64(at), 0)
-	a.MTime = time.Unix(int64(mt), 0)
-	return p
-}
\ No newline at end of file
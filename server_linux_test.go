@@ -0,0 +1,61 @@
+// +build linux
+
+package sftpd
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	// 内核的 openat2 和用户态的逐级解析都要试一遍; seccomp 规则对 openat2
+	// 返回 EPERM 时要改为逐级解析
+	resolveModes["walk"] = func() func() {
+		old := atomic.SwapInt32(&noOpenat2, 1)
+		return func() { atomic.StoreInt32(&noOpenat2, old) }
+	}
+	resolveModes["seccomp"] = denyOpenat2
+}
+
+// denyOpenat2 makes openat2 fail with EPERM like a seccomp filter.
+func denyOpenat2() func() {
+	old := atomic.SwapInt32(&noOpenat2, 0)
+	tryOpenat2 = func(int, string, int, uint32) (int, error) { return -1, unix.EPERM }
+	return func() {
+		tryOpenat2 = openat2
+		atomic.StoreInt32(&noOpenat2, old)
+	}
+}
+
+func TestOpenat2Denied(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	failOnErr(t, ioutil.WriteFile(dir+"/a", []byte("a"), 0644), "WriteFile")
+	defer denyOpenat2()()
+	f, e := fs.OpenFile("/a", SSH_FXF_READ, &Attr{})
+	failOnErr(t, e, "OpenFile")
+	f.Close()
+	if atomic.LoadInt32(&noOpenat2) != 1 {
+		t.Fatal("EPERM of openat2 did not switch to walking paths")
+	}
+}
+
+func TestXattrsOfSpecialFiles(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	failOnErr(t, unix.Mkfifo(dir+"/fifo", 0600), "Mkfifo")
+	// 不打开 FIFO 和设备, 其他属性照常返回
+	a, e := fs.Stat("/fifo", false)
+	failOnErr(t, e, "Stat")
+	if a.Mode&os.ModeNamedPipe == 0 || a.Flags&ATTR_EXTENDED != 0 {
+		t.Errorf("fifo stat %v %q", a.Mode, a.Extended)
+	}
+	e = fs.SetStat("/fifo", &Attr{Flags: ATTR_EXTENDED, Extended: []string{"user.k", "v"}})
+	if statusCode(e) != SSH_FX_OP_UNSUPPORTED {
+		t.Errorf("setting extended attributes of a fifo: %v", e)
+	}
+}
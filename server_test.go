@@ -1,15 +1,27 @@
 package sftpd
 
 import (
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
+	"path"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	client "github.com/pkg/sftp"
+	"github.com/taruti/binp"
 	"github.com/taruti/sshutil"
 	"golang.org/x/crypto/ssh"
 )
@@ -227,7 +239,7 @@ func (d rdir) Readdir(count int, handles Handles) ([]NamedAttr, error) {
 	nas := make([]NamedAttr, len(fis))
 	for i, fi := range fis {
 		nas[i].Name = fi.Name()
-		nas[i].FillFrom(fi, 0)
+		nas[i].FillFrom(fi)
 	}
 	return nas, nil
 }
@@ -290,7 +302,1690 @@ func (fs rfs) Stat(name string, islstat bool) (*Attr, error) {
 		return nil, e
 	}
 	var a Attr
-	a.FillFrom(fi, 0)
+	a.FillFrom(fi)
 
 	return &a, nil
 }
+
+func TestBarrierOrder(t *testing.T) {
+	b := newBarrier()
+	var log []string
+	var mu sync.Mutex
+	record := func(s string) {
+		mu.Lock()
+		log = append(log, s)
+		mu.Unlock()
+	}
+	r1 := b.enter(false)
+	r2 := b.enter(false)
+	w := b.enter(true)
+	r3 := b.enter(false)
+
+	done := make(chan struct{})
+	go func() {
+		r3.wait()
+		record("r3")
+		r3.release()
+		close(done)
+	}()
+	go func() {
+		w.wait()
+		record("w")
+		w.release()
+	}()
+	r1.wait()
+	r2.wait()
+	record("r")
+	r1.release()
+	r2.release()
+	<-done
+	if strings.Join(log, ",") != "r,w,r3" {
+		t.Fatalf("requests ran out of order: %v", log)
+	}
+}
+
+func TestSchedulerForgetsClosedHandles(t *testing.T) {
+	var h Handles
+	h.Init()
+	sched := newScheduler(h)
+	k := h.NewDir(EmptyDir{})
+	readdir := binp.Out().B32(1).B32String(k).Out()
+	sched.ticket(SSH_FXP_READDIR, readdir).release()
+	if sched.handles[k] == nil {
+		t.Fatal("READDIR got no barrier")
+	}
+	// READDIR 读到末尾时关闭的句柄和 CLOSE 一样释放
+	h.CloseHandle(k)
+	sched.ticket(SSH_FXP_STAT, binp.Out().B32(2).B32String("/").Out()).release()
+	if len(sched.handles) != 0 {
+		t.Fatalf("barriers of closed handles kept: %v", sched.handles)
+	}
+}
+
+func TestAttrVersions(t *testing.T) {
+	in := Attr{
+		Flags: ATTR_SIZE | ATTR_UIDGID | ATTR_MODE | ATTR_TIME,
+		Size:  1234,
+		Uid:   1000,
+		Gid:   100,
+		Mode:  os.ModeDir | 0755,
+		ATime: time.Unix(1500000000, 5),
+		MTime: time.Unix(1600000000, 7),
+	}
+	for v := uint32(MinVersion); v <= MaxVersion; v++ {
+		o := binp.Out()
+		outAttr(o, &in, v)
+		var out Attr
+		e := parseAttr(binp.NewParser(o.Out()), &out, v).End()
+		failOnErr(t, e, "parseAttr")
+		if v <= 3 {
+			in3 := in
+			in3.ATime, in3.MTime = time.Unix(in.ATime.Unix(), 0), time.Unix(in.MTime.Unix(), 0)
+			if !reflect.DeepEqual(in3, out) {
+				t.Fatalf("version %d: %+v != %+v", v, in3, out)
+			}
+			continue
+		}
+		out.User, out.Group = "", ""
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("version %d: %+v != %+v", v, in, out)
+		}
+	}
+}
+
+// pipeChannel connects ServeChannel to an in-process client.
+type pipeChannel struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func (*pipeChannel) CloseWrite() error { return nil }
+func (*pipeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return true, nil
+}
+func (*pipeChannel) Stderr() io.ReadWriter { return nil }
+
+func newTestClient(t *testing.T, fs FileSystem, opts *Options, clopts ...client.ClientOption) *client.Client {
+	crd, swr := io.Pipe()
+	srd, cwr := io.Pipe()
+	go func() {
+		ServeChannelWith(&pipeChannel{srd, swr}, fs, opts)
+		crd.Close()
+	}()
+	cl, e := client.NewClientPipe(crd, cwr, clopts...)
+	failOnErr(t, e, "NewClientPipe")
+	return cl
+}
+
+func newTestLocalFs(t *testing.T) (*LocalFs, string) {
+	dir, e := ioutil.TempDir("", "sftpd-test")
+	failOnErr(t, e, "TempDir")
+	return NewLocalFs(dir + "/"), dir
+}
+
+func TestSecondInit(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	crd, swr := io.Pipe()
+	srd, cwr := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeChannelWith(&pipeChannel{srd, swr}, fs, nil)
+		crd.Close()
+	}()
+	go io.Copy(ioutil.Discard, crd)
+	pkt := binp.Out().B32(5).Byte(SSH_FXP_INIT).B32(3).Out()
+	_, e := cwr.Write(pkt)
+	failOnErr(t, e, "Write")
+	// 第二个 INIT 结束会话, 不改变协商好的版本
+	_, e = cwr.Write(pkt)
+	failOnErr(t, e, "Write")
+	select {
+	case e = <-done:
+		if e == nil {
+			t.Fatal("second SSH_FXP_INIT ended the session without an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second SSH_FXP_INIT was accepted")
+	}
+	cwr.Close()
+}
+
+func TestPosixRename(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	cl := newTestClient(t, fs, nil)
+	defer cl.Close()
+
+	failOnErr(t, ioutil.WriteFile(dir+"/tmp", []byte("new"), 0644), "WriteFile")
+	failOnErr(t, ioutil.WriteFile(dir+"/dst", []byte("old"), 0644), "WriteFile")
+	failOnErr(t, cl.PosixRename("/tmp", "/dst"), "PosixRename")
+	bs, e := ioutil.ReadFile(dir + "/dst")
+	failOnErr(t, e, "ReadFile")
+	if string(bs) != "new" {
+		t.Fatalf("dst contains %q", bs)
+	}
+}
+
+func TestStatVFS(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	cl := newTestClient(t, fs, nil)
+	defer cl.Close()
+
+	st, e := cl.StatVFS("/")
+	failOnErr(t, e, "StatVFS")
+	if st.Blocks == 0 || st.Frsize == 0 {
+		t.Fatalf("empty statvfs reply: %+v", st)
+	}
+}
+
+func TestHardLink(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	outside, e := ioutil.TempDir("", "sftpd-outside")
+	failOnErr(t, e, "TempDir")
+	defer os.RemoveAll(outside)
+	cl := newTestClient(t, fs, nil)
+	defer cl.Close()
+
+	failOnErr(t, ioutil.WriteFile(dir+"/a", []byte("a"), 0644), "WriteFile")
+	failOnErr(t, cl.Link("/a", "/b"), "Link")
+	fa, _ := os.Stat(dir + "/a")
+	fb, e := os.Stat(dir + "/b")
+	failOnErr(t, e, "Stat")
+	if !os.SameFile(fa, fb) {
+		t.Fatal("b is not a hard link to a")
+	}
+
+	failOnErr(t, ioutil.WriteFile(outside+"/secret", []byte("s"), 0600), "WriteFile")
+	failOnErr(t, os.Symlink(outside, dir+"/out"), "Symlink")
+	if cl.Link("/out/secret", "/stolen") == nil {
+		t.Fatal("hard link escaped the root")
+	}
+}
+
+// syncFs records the Sync calls of its files and its SyncDir calls.
+type syncFs struct {
+	*LocalFs
+	mu    *sync.Mutex
+	calls *[]string
+}
+
+type syncFile struct {
+	File
+	fs   syncFs
+	name string
+}
+
+func (fs syncFs) record(call string) {
+	fs.mu.Lock()
+	*fs.calls = append(*fs.calls, call)
+	fs.mu.Unlock()
+}
+
+func (fs syncFs) take() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	calls := *fs.calls
+	*fs.calls = nil
+	return calls
+}
+
+func (fs syncFs) OpenFile(name string, flags uint32, attr *Attr) (File, error) {
+	f, e := fs.LocalFs.OpenFile(name, flags, attr)
+	if e != nil {
+		return nil, e
+	}
+	return syncFile{f, fs, name}, nil
+}
+
+func (fs syncFs) SyncDir(path string) error {
+	fs.record("SyncDir " + path)
+	return fs.LocalFs.SyncDir(path)
+}
+
+func (f syncFile) Sync() error {
+	f.fs.record("Sync " + f.name)
+	return f.File.(Syncer).Sync()
+}
+
+func TestSyncOnClose(t *testing.T) {
+	lfs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	failOnErr(t, os.Mkdir(dir+"/d", 0755), "Mkdir")
+	fs := syncFs{lfs, &sync.Mutex{}, new([]string)}
+	cl := newTestClient(t, fs, &Options{SyncOnClose: true})
+	defer cl.Close()
+
+	f, e := cl.Create("/d/new")
+	failOnErr(t, e, "Create")
+	_, e = f.Write([]byte("durable"))
+	failOnErr(t, e, "Write")
+	failOnErr(t, f.Close(), "Close")
+	bs, e := ioutil.ReadFile(dir + "/d/new")
+	failOnErr(t, e, "ReadFile")
+	if string(bs) != "durable" {
+		t.Fatalf("new contains %q", bs)
+	}
+	if calls := fs.take(); strings.Join(calls, ",") != "Sync /d/new,SyncDir /d" {
+		t.Fatalf("closing a new file synced %v", calls)
+	}
+
+	// 已存在的文件只同步文件本身, 只读的文件不同步
+	f, e = cl.OpenFile("/d/new", os.O_WRONLY)
+	failOnErr(t, e, "OpenFile")
+	failOnErr(t, f.Close(), "Close")
+	f, e = cl.Open("/d/new")
+	failOnErr(t, e, "Open")
+	failOnErr(t, f.Close(), "Close")
+	if calls := fs.take(); strings.Join(calls, ",") != "Sync /d/new" {
+		t.Fatalf("closing existing files synced %v", calls)
+	}
+
+	// fsync@openssh.com
+	var out strings.Builder
+	s := &session{fs: fs, out: &out, opts: (*Options)(nil).withDefaults()}
+	s.h.Init()
+	defer s.h.CloseAll()
+	sf, e := fs.OpenFile("/d/new", SSH_FXF_WRITE, &Attr{})
+	failOnErr(t, e, "OpenFile")
+	handle := s.h.newOpenFile(sf, &openFile{path: "/d/new", flags: SSH_FXF_WRITE})
+	failOnErr(t, s.fsync(1, binp.NewParser(binp.Out().B32String(handle).Out())), "fsync")
+	if code := SSH_FX([]byte(out.String())[12]); code != SSH_FX_OK {
+		t.Fatalf("fsync@openssh.com: %v", code)
+	}
+	if calls := fs.take(); strings.Join(calls, ",") != "Sync /d/new" {
+		t.Fatalf("fsync@openssh.com synced %v", calls)
+	}
+}
+
+func TestLSetStat(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+
+	failOnErr(t, ioutil.WriteFile(dir+"/a", []byte("a"), 0644), "WriteFile")
+	failOnErr(t, os.Symlink("a", dir+"/l"), "Symlink")
+	target, _ := os.Stat(dir + "/a")
+	mtime := time.Unix(1000000000, 0)
+	a := Attr{Flags: ATTR_TIME, MTime: mtime}
+	failOnErr(t, fs.LSetStat("/l", &a), "LSetStat")
+	fi, e := os.Lstat(dir + "/l")
+	failOnErr(t, e, "Lstat")
+	if !fi.ModTime().Equal(mtime) {
+		t.Fatalf("link mtime %v, want %v", fi.ModTime(), mtime)
+	}
+	fi, _ = os.Stat(dir + "/a")
+	if !fi.ModTime().Equal(target.ModTime()) {
+		t.Fatal("lsetstat followed the link")
+	}
+	if fs.LSetStat("/l", &Attr{Flags: ATTR_MODE, Mode: 0600}) == nil {
+		t.Fatal("chmod of a link succeeded")
+	}
+}
+
+func TestLargePackets(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 128*1024)
+	_, e := io.ReadFull(rand.Reader, data)
+	failOnErr(t, e, "rand")
+	cl := newTestClient(t, fs, nil, client.MaxPacketUnchecked(len(data)))
+	defer cl.Close()
+	f, e := cl.Create("/big")
+	failOnErr(t, e, "Create")
+	_, e = f.Write(data)
+	failOnErr(t, e, "Write")
+	f.Close()
+	f, e = cl.Open("/big")
+	failOnErr(t, e, "Open")
+	got, e := ioutil.ReadAll(f)
+	failOnErr(t, e, "ReadAll")
+	f.Close()
+	if !reflect.DeepEqual(got, data) {
+		t.Fatal("read back differs")
+	}
+
+	cl = newTestClient(t, fs, &Options{MaxPacketLength: 64 * 1024}, client.MaxPacketUnchecked(len(data)))
+	defer cl.Close()
+	f, e = cl.OpenFile("/big", os.O_WRONLY)
+	failOnErr(t, e, "OpenFile")
+	if _, e = f.Write(data); e == nil {
+		t.Fatal("write over the packet limit succeeded")
+	}
+	f.Close()
+	_, e = cl.Stat("/big")
+	failOnErr(t, e, "Stat after too long packet")
+}
+
+func TestLimits(t *testing.T) {
+	var out strings.Builder
+	s := &session{out: &out, opts: (&Options{MaxPacketLength: 100000}).withDefaults()}
+	failOnErr(t, s.limits(7, binp.NewParser(nil)), "limits")
+	var (
+		plen, id             uint32
+		op                   byte
+		pkt, rd, wr, handles uint64
+	)
+	e := binp.NewParser([]byte(out.String())).B32(&plen).Byte(&op).B32(&id).B64(&pkt).B64(&rd).B64(&wr).B64(&handles).End()
+	failOnErr(t, e, "parse reply")
+	if op != SSH_FXP_EXTENDED_REPLY || id != 7 || pkt != 100000 || rd != 100000-1024 || wr != rd || handles != maxFiles {
+		t.Fatalf("bad limits reply %d %d %d %d %d %d", op, id, pkt, rd, wr, handles)
+	}
+}
+
+func TestHomeDir(t *testing.T) {
+	cl := newTestClient(t, EmptyFS{}, &Options{HomeDir: "/home/test"})
+	defer cl.Close()
+	wd, e := cl.Getwd()
+	failOnErr(t, e, "Getwd")
+	if wd != "/home/test" {
+		t.Fatalf("Getwd = %q, want /home/test", wd)
+	}
+
+	s := &session{fs: EmptyFS{}, opts: (&Options{
+		HomeDir: "/home/test",
+		UserHomeDir: func(user string) (string, error) {
+			return "/home/" + user, nil
+		},
+	}).withDefaults()}
+	for in, want := range map[string]string{
+		"~":         "/home/test",
+		"~/a/../b":  "/home/test/b",
+		"~other/c":  "/home/other/c",
+		"d":         "/home/test/d",
+		"/etc/../x": "/etc/../x",
+	} {
+		got, e := s.expandPath(in)
+		failOnErr(t, e, "expandPath")
+		if got, _ = s.fs.RealPath(got); got != path.Clean(want) {
+			t.Errorf("expandPath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	failOnErr(t, ioutil.WriteFile(dir+"/a", []byte("0123456789"), 0640), "WriteFile")
+
+	var out strings.Builder
+	s := &session{fs: fs, out: &out, opts: (*Options)(nil).withDefaults()}
+	s.h.Init()
+	defer s.h.CloseAll()
+	status := func() SSH_FX {
+		bs := []byte(out.String())
+		out.Reset()
+		return SSH_FX(bs[12])
+	}
+	open := func(name string, flags uint32) string {
+		f, e := fs.OpenFile(name, flags, &Attr{})
+		failOnErr(t, e, "OpenFile")
+		return s.h.newOpenFile(f, &openFile{path: name, flags: flags})
+	}
+	copyData := func(rh string, roff, length uint64, wh string, woff uint64) SSH_FX {
+		bs := binp.Out().B32String(rh).B64(roff).B64(length).B32String(wh).B64(woff).Out()
+		failOnErr(t, s.copyData(1, binp.NewParser(bs)), "copyData")
+		return status()
+	}
+
+	rh := open("/a", SSH_FXF_READ)
+	wh := open("/b", SSH_FXF_WRITE|SSH_FXF_CREAT)
+	if code := copyData(rh, 2, 5, wh, 1); code != SSH_FX_OK {
+		t.Fatalf("copy-data: %v", code)
+	}
+	if bs, _ := ioutil.ReadFile(dir + "/b"); string(bs) != "\x0023456" {
+		t.Fatalf("copied %q", bs)
+	}
+	if code := copyData(wh, 0, 0, rh, 0); code != SSH_FX_PERMISSION_DENIED {
+		t.Fatalf("copy-data against open modes: %v", code)
+	}
+	rw := open("/a", SSH_FXF_READ|SSH_FXF_WRITE)
+	if code := copyData(rw, 0, 0, rw, 4); code != SSH_FX_FAILURE {
+		t.Fatalf("overlapping copy-data: %v", code)
+	}
+
+	if s.copyPath("/a", "/b", false) == nil {
+		t.Fatal("copy-file replaced an existing file")
+	}
+	failOnErr(t, s.copyPath("/a", "/c", false), "copy-file")
+	if bs, _ := ioutil.ReadFile(dir + "/c"); string(bs) != "0123456789" {
+		t.Fatalf("copied %q", bs)
+	}
+	failOnErr(t, ioutil.WriteFile(dir+"/long", []byte("abcdefghijklmnop"), 0644), "WriteFile")
+	failOnErr(t, s.copyPath("/a", "/long", true), "copy-file overwrite")
+	if bs, _ := ioutil.ReadFile(dir + "/long"); string(bs) != "0123456789" {
+		t.Fatalf("overwritten %q", bs)
+	}
+
+	// 目标是源文件本身时不能截断源文件
+	failOnErr(t, os.Link(dir+"/a", dir+"/hard"), "Link")
+	failOnErr(t, os.Symlink("a", dir+"/sym"), "Symlink")
+	for _, dst := range []string{"//a/.", "/d/../a", "/hard", "/sym"} {
+		if e := s.copyPath("/a", dst, true); !os.IsExist(e) {
+			t.Errorf("copy-file onto %s: %v", dst, e)
+		}
+		if bs, _ := ioutil.ReadFile(dir + "/a"); string(bs) != "0123456789" {
+			t.Fatalf("copy-file onto %s left %q", dst, bs)
+		}
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	data := make([]byte, 600)
+	_, e := io.ReadFull(rand.Reader, data)
+	failOnErr(t, e, "rand")
+	failOnErr(t, ioutil.WriteFile(dir+"/a", data, 0644), "WriteFile")
+
+	var out strings.Builder
+	s := &session{fs: fs, out: &out, opts: (*Options)(nil).withDefaults()}
+	check := func(list string, offset, length uint64, blockSize uint32) (string, []byte) {
+		bs := binp.Out().B32String("/a").B32String(list).B64(offset).B64(length).B32(blockSize).Out()
+		failOnErr(t, s.checkFileName(1, binp.NewParser(bs)), "checkFileName")
+		var (
+			plen, id  uint32
+			op        byte
+			ext, name string
+		)
+		reply := []byte(out.String())
+		out.Reset()
+		p := binp.NewParser(reply).B32(&plen).Byte(&op).B32(&id)
+		if op != SSH_FXP_EXTENDED_REPLY {
+			t.Fatalf("reply %d", op)
+		}
+		var sum []byte
+		p.B32String(&ext).B32String(&name).PeekRest(&sum)
+		return name, sum
+	}
+
+	name, sum := check("crc32,md5,sha256", 0, 0, 0)
+	if want := md5.Sum(data); name != "md5" || string(sum) != string(want[:]) {
+		t.Fatalf("md5 = %s %x", name, sum)
+	}
+	name, sum = check("sha256", 100, 200, 0)
+	if want := sha256.Sum256(data[100:300]); name != "sha256" || string(sum) != string(want[:]) {
+		t.Fatalf("range sha256 = %s %x", name, sum)
+	}
+	_, sum = check("sha1", 0, 0, 256)
+	var want []byte
+	for i := 0; i < len(data); i += 256 {
+		end := i + 256
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[i:end])
+		want = append(want, h[:]...)
+	}
+	if string(sum) != string(want) {
+		t.Fatalf("block sha1 = %x, want %x", sum, want)
+	}
+}
+
+func TestSftpFsCheckFile(t *testing.T) {
+	up, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	data := make([]byte, 1000)
+	_, e := io.ReadFull(rand.Reader, data)
+	failOnErr(t, e, "rand")
+	failOnErr(t, ioutil.WriteFile(dir+"/a", data, 0644), "WriteFile")
+
+	// sftpFs 的文件通过 ReadAt 在本地计算
+	cl := newTestClient(t, up, nil)
+	defer cl.Close()
+	var out strings.Builder
+	s := &session{fs: NewSftpFs(cl), out: &out, opts: (*Options)(nil).withDefaults()}
+	f, e := s.fs.OpenFile("/a", SSH_FXF_READ, &Attr{})
+	failOnErr(t, e, "OpenFile")
+	defer f.Close()
+	failOnErr(t, s.checkFile(1, f, "md5", 100, 200, 0), "checkFile")
+	if want := md5.Sum(data[100:300]); !strings.HasSuffix(out.String(), string(want[:])) {
+		t.Fatal("md5 of sftpFs file differs")
+	}
+}
+
+// slowFs counts how many reads of its files run at the same time.
+type slowFs struct {
+	*LocalFs
+	mu      *sync.Mutex
+	n, most *int
+}
+
+type slowFile struct {
+	File
+	fs slowFs
+}
+
+func (fs slowFs) OpenFile(name string, flags uint32, attr *Attr) (File, error) {
+	f, e := fs.LocalFs.OpenFile(name, flags, attr)
+	if e != nil {
+		return nil, e
+	}
+	return slowFile{f, fs}, nil
+}
+
+func (f slowFile) ReadAt(bs []byte, pos int64) (int, error) {
+	f.fs.mu.Lock()
+	if *f.fs.n++; *f.fs.n > *f.fs.most {
+		*f.fs.most = *f.fs.n
+	}
+	f.fs.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	f.fs.mu.Lock()
+	*f.fs.n--
+	f.fs.mu.Unlock()
+	return f.File.ReadAt(bs, pos)
+}
+
+func TestSftpFsConcurrentReads(t *testing.T) {
+	lfs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	up := slowFs{lfs, &sync.Mutex{}, new(int), new(int)}
+	data := make([]byte, 800)
+	_, e := io.ReadFull(rand.Reader, data)
+	failOnErr(t, e, "rand")
+	failOnErr(t, ioutil.WriteFile(dir+"/a", data, 0644), "WriteFile")
+	cl := newTestClient(t, up, nil)
+	defer cl.Close()
+	sfs := NewSftpFs(cl)
+
+	readAll := func(f File) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(off int) {
+				defer wg.Done()
+				bs := make([]byte, 100)
+				_, e := f.ReadAt(bs, int64(off))
+				if e != nil || string(bs) != string(data[off:off+100]) {
+					t.Errorf("read at %d: %v", off, e)
+				}
+			}(i * 100)
+		}
+		wg.Wait()
+	}
+	most := func() int {
+		up.mu.Lock()
+		defer up.mu.Unlock()
+		m := *up.most
+		*up.most = 0
+		return m
+	}
+
+	// 并发的读取通过多个上游句柄同时进行
+	f, e := sfs.OpenFile("/a", SSH_FXF_READ|SSH_FXF_WRITE, &Attr{})
+	failOnErr(t, e, "OpenFile")
+	defer f.Close()
+	readAll(f)
+	if m := most(); m < 2 {
+		t.Fatalf("at most %d reads upstream at a time", m)
+	}
+	// 写入之后只使用原来的句柄
+	_, e = f.WriteAt(data[:1], 0)
+	failOnErr(t, e, "WriteAt")
+	readAll(f)
+	if m := most(); m != 1 {
+		t.Fatalf("%d reads upstream at a time after a write", m)
+	}
+	if sf := f.(*SftpFile); sf.nreaders != 0 || len(sf.readers) != 0 {
+		t.Fatalf("%d readers left open", sf.nreaders)
+	}
+
+	// 文件被替换后不会读到新文件
+	g, e := sfs.OpenFile("/a", SSH_FXF_READ, &Attr{})
+	failOnErr(t, e, "OpenFile")
+	defer g.Close()
+	failOnErr(t, os.Rename(dir+"/a", dir+"/old"), "Rename")
+	failOnErr(t, ioutil.WriteFile(dir+"/a", []byte("new"), 0644), "WriteFile")
+	readAll(g)
+}
+
+func TestUsersGroupsByID(t *testing.T) {
+	up, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	failOnErr(t, os.Mkdir(dir+"/etc", 0755), "Mkdir")
+	failOnErr(t, ioutil.WriteFile(dir+"/etc/passwd", []byte("# users\nroot:x:0:0:root:/root:/bin/sh\nalice:x:1000:1000::/home/alice:/bin/sh\nbad:x:nan:1\n"), 0644), "WriteFile")
+	failOnErr(t, ioutil.WriteFile(dir+"/etc/group", []byte("wheel:x:10:alice\n"), 0644), "WriteFile")
+	cl := newTestClient(t, up, nil)
+	defer cl.Close()
+
+	var out strings.Builder
+	s := &session{fs: NewSftpFs(cl), out: &out, opts: (*Options)(nil).withDefaults()}
+	uids := binp.Out().B32(1000).B32(0).B32(7).Out()
+	gids := binp.Out().B32(10).Out()
+	bs := binp.Out().B32Bytes(uids).B32Bytes(gids).Out()
+	failOnErr(t, s.usersGroupsByID(3, binp.NewParser(bs)), "usersGroupsByID")
+
+	var (
+		plen, id       uint32
+		op             byte
+		users, groups  []byte
+		u1, u2, u3, g1 string
+	)
+	e := binp.NewParser([]byte(out.String())).B32(&plen).Byte(&op).B32(&id).B32Bytes(&users).B32Bytes(&groups).End()
+	failOnErr(t, e, "parse reply")
+	failOnErr(t, binp.NewParser(users).B32String(&u1).B32String(&u2).B32String(&u3).End(), "parse users")
+	failOnErr(t, binp.NewParser(groups).B32String(&g1).End(), "parse groups")
+	if op != SSH_FXP_EXTENDED_REPLY || u1 != "alice" || u2 != "root" || u3 != "" || g1 != "wheel" {
+		t.Fatalf("bad reply %d %q %q %q %q", op, u1, u2, u3, g1)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	failOnErr(t, os.Mkdir(dir+"/d", 0755), "Mkdir")
+	failOnErr(t, ioutil.WriteFile(dir+"/a", []byte("a"), 0644), "WriteFile")
+
+	cl := newTestClient(t, fs, nil)
+	defer cl.Close()
+	for _, c := range []struct{ link, target, want string }{
+		{"/l", "a", "a"},
+		{"/d/l", "/a", "../a"},
+		{"/d/up", "../../../../a", "../a"},
+	} {
+		failOnErr(t, cl.Symlink(c.target, c.link), "Symlink")
+		got, e := os.Readlink(dir + c.link)
+		failOnErr(t, e, "Readlink")
+		if got != c.want {
+			t.Errorf("link %s -> %q, want %q", c.link, got, c.want)
+		}
+		bs, e := ioutil.ReadFile(dir + c.link)
+		if e != nil || string(bs) != "a" {
+			t.Errorf("link %s does not resolve to a: %v", c.link, e)
+		}
+	}
+
+	draft := newTestClient(t, fs, &Options{ClientVersion: "SSH-2.0-WinSCP_release_5.17"})
+	defer draft.Close()
+	// 草案顺序: 先 linkpath 后 targetpath
+	failOnErr(t, draft.Symlink("/l2", "a"), "Symlink")
+	if got, _ := os.Readlink(dir + "/l2"); got != "a" {
+		t.Fatalf("draft order link -> %q", got)
+	}
+}
+
+func TestReversedSymlink(t *testing.T) {
+	for _, c := range []struct {
+		banner string
+		want   bool
+	}{
+		{"", true},
+		{"SSH-2.0-OpenSSH_8.2p1 Ubuntu-4ubuntu0.1", true},
+		{"SSH-2.0-Go", true},
+		{"SSH-2.0-PuTTY_Release_0.74", false},
+		{"SSH-2.0-WinSCP_release_5.17", false},
+		{"SSH-2.0-FileZilla_3.50.0", false},
+	} {
+		if got := reversedSymlink(c.banner); got != c.want {
+			t.Errorf("reversedSymlink(%q) = %v, want %v", c.banner, got, c.want)
+		}
+	}
+}
+
+func TestStatusReplies(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	cl := newTestClient(t, fs, nil)
+	defer cl.Close()
+
+	failOnErr(t, ioutil.WriteFile(dir+"/a", []byte("a"), 0644), "WriteFile")
+	failOnErr(t, ioutil.WriteFile(dir+"/b", []byte("b"), 0644), "WriteFile")
+	failOnErr(t, os.Mkdir(dir+"/d", 0755), "Mkdir")
+	failOnErr(t, ioutil.WriteFile(dir+"/d/f", []byte("f"), 0644), "WriteFile")
+
+	// 每个失败的请求只有一个回复, 后面的请求不受影响
+	if e := cl.Rename("/a", "/b"); e == nil {
+		t.Fatal("rename over an existing file succeeded")
+	}
+	if _, e := cl.Stat("/missing"); !os.IsNotExist(e) {
+		t.Fatalf("stat of a missing file: %v", e)
+	}
+	if e := cl.Remove("/missing"); !os.IsNotExist(e) {
+		t.Fatalf("remove of a missing file: %v", e)
+	}
+	if e := cl.Mkdir("/d"); e == nil {
+		t.Fatal("mkdir of an existing directory succeeded")
+	}
+	f, e := cl.Open("/d")
+	failOnErr(t, e, "Open")
+	if _, e = f.Read(make([]byte, 10)); e == nil || e == io.EOF {
+		t.Fatalf("read of a directory: %v", e)
+	}
+	f.Close()
+	_, e = cl.Stat("/a")
+	failOnErr(t, e, "Stat after failures")
+
+	// 不认识的请求类型得到带请求 id 的 SSH_FX_OP_UNSUPPORTED
+	var out strings.Builder
+	s := &session{fs: fs, out: &out, opts: (*Options)(nil).withDefaults(), version: 3}
+	failOnErr(t, s.handle(99, binp.Out().B32(7).Out()), "handle")
+	var (
+		plen, id, code uint32
+		op             byte
+	)
+	binp.NewParser([]byte(out.String())).B32(&plen).Byte(&op).B32(&id).B32(&code)
+	if op != SSH_FXP_STATUS || id != 7 || SSH_FX(code) != SSH_FX_OP_UNSUPPORTED {
+		t.Fatalf("unknown request: op %d id %d code %d", op, id, code)
+	}
+
+	// 关闭文件失败时 CLOSE 回复错误
+	ccl := newTestClient(t, failCloseFs{fs}, nil)
+	defer ccl.Close()
+	f, e = ccl.Create("/c")
+	failOnErr(t, e, "Create")
+	if e = f.Close(); e == nil {
+		t.Fatal("failed close replied OK")
+	}
+}
+
+// failCloseFs opens files whose Close fails after closing them.
+type failCloseFs struct {
+	*LocalFs
+}
+
+type failCloseFile struct {
+	File
+}
+
+func (fs failCloseFs) OpenFile(name string, flags uint32, attr *Attr) (File, error) {
+	f, e := fs.LocalFs.OpenFile(name, flags, attr)
+	if e != nil {
+		return nil, e
+	}
+	return failCloseFile{f}, nil
+}
+
+func (f failCloseFile) Close() error {
+	f.File.Close()
+	return errors.New("close failed")
+}
+
+func TestStatusCodes(t *testing.T) {
+	for _, c := range []struct {
+		e       error
+		version uint32
+		code    SSH_FX
+	}{
+		{nil, 3, SSH_FX_OK},
+		{io.EOF, 3, SSH_FX_EOF},
+		{&os.PathError{Op: "open", Path: "/srv/x", Err: os.ErrNotExist}, 3, SSH_FX_NO_SUCH_FILE},
+		{&os.PathError{Op: "open", Path: "/srv/x", Err: syscall.EACCES}, 3, SSH_FX_PERMISSION_DENIED},
+		{&os.LinkError{Op: "rename", Old: "/a", New: "/b", Err: syscall.EEXIST}, 6, SSH_FX_FILE_ALREADY_EXISTS},
+		{&os.LinkError{Op: "rename", Old: "/a", New: "/b", Err: syscall.EEXIST}, 3, SSH_FX_FAILURE},
+		{&os.PathError{Op: "write", Path: "/srv/x", Err: syscall.ENOSPC}, 5, SSH_FX_NO_SPACE_ON_FILESYSTEM},
+		{&os.PathError{Op: "open", Path: "/srv/x", Err: syscall.ENOTDIR}, 4, SSH_FX_NO_SUCH_PATH},
+		{&os.PathError{Op: "open", Path: "/srv/x", Err: syscall.ENOTDIR}, 3, SSH_FX_NO_SUCH_FILE},
+		{NewStatusError(SSH_FX_WRITE_PROTECT, "read only"), 3, SSH_FX_PERMISSION_DENIED},
+		{errors.New("other"), 6, SSH_FX_FAILURE},
+		{&os.PathError{Op: "read", Path: "/srv/x", Err: syscall.EAGAIN}, 6, SSH_FX_FAILURE},
+	} {
+		if code := downgradeStatus(statusCode(c.e), c.version); code != c.code {
+			t.Errorf("%v in version %d: %v, want %v", c.e, c.version, code, c.code)
+		}
+	}
+	msg := statusMessage(SSH_FX_NO_SUCH_FILE, &os.PathError{Op: "open", Path: "/srv/root/x", Err: syscall.ENOENT})
+	if strings.Contains(msg, "/srv") || msg == "" {
+		t.Errorf("message %q", msg)
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	failOnErr(t, ioutil.WriteFile(dir+"/a", []byte("a"), 0640), "WriteFile")
+
+	e := fs.SetStat("/a", &Attr{Flags: ATTR_EXTENDED, Extended: []string{"user.tag", "archived"}})
+	if statusCode(e) == SSH_FX_OP_UNSUPPORTED {
+		t.Skip("no user extended attributes:", e)
+	}
+	failOnErr(t, e, "SetStat")
+	a, e := fs.Stat("/a", false)
+	failOnErr(t, e, "Stat")
+	if a.Mode.Perm() != 0640 {
+		t.Errorf("setstat of extended attributes changed the mode to %v", a.Mode)
+	}
+	if !reflect.DeepEqual(a.Extended, []string{"user.tag", "archived"}) {
+		t.Errorf("Extended = %q", a.Extended)
+	}
+	// 不需要扩展属性时不读取
+	a, e = fs.StatAttrs("/a", false, ATTR_SIZE)
+	failOnErr(t, e, "StatAttrs")
+	if a.Flags&ATTR_EXTENDED != 0 || a.Extended != nil {
+		t.Errorf("Extended read without being asked for: %q", a.Extended)
+	}
+
+	// lsetstat 设置普通文件的扩展属性, 软链接本身没有
+	failOnErr(t, fs.LSetStat("/a", &Attr{Flags: ATTR_EXTENDED, Extended: []string{"user.l", "1"}}), "LSetStat")
+	a, e = fs.Stat("/a", true)
+	failOnErr(t, e, "Stat")
+	if !reflect.DeepEqual(a.Extended, []string{"user.tag", "archived", "user.l", "1"}) &&
+		!reflect.DeepEqual(a.Extended, []string{"user.l", "1", "user.tag", "archived"}) {
+		t.Errorf("Extended after lsetstat = %q", a.Extended)
+	}
+	failOnErr(t, fs.CreateLink("/l", "a", 0), "CreateLink")
+	if e = fs.LSetStat("/l", &Attr{Flags: ATTR_EXTENDED, Extended: []string{"user.l", "2"}}); e == nil {
+		t.Error("lsetstat of extended attributes of a link succeeded")
+	}
+
+	f, e := fs.OpenFile("/b", SSH_FXF_WRITE|SSH_FXF_CREAT, &Attr{Flags: ATTR_EXTENDED, Extended: []string{"user.k", "v"}})
+	failOnErr(t, e, "OpenFile")
+	a, e = f.FStat()
+	failOnErr(t, e, "FStat")
+	f.Close()
+	if !reflect.DeepEqual(a.Extended, []string{"user.k", "v"}) {
+		t.Errorf("Extended of a created file = %q", a.Extended)
+	}
+
+	s := &session{opts: (*Options)(nil).withDefaults()}
+	if s.checkXattrs(&Attr{Flags: ATTR_EXTENDED, Extended: []string{"trusted.x", "1"}}) == nil {
+		t.Error("trusted namespace allowed")
+	}
+	a = &Attr{Flags: ATTR_EXTENDED, Extended: []string{"security.selinux", "x", "user.k", "v"}}
+	s.filterXattrs(a)
+	if !reflect.DeepEqual(a.Extended, []string{"user.k", "v"}) {
+		t.Errorf("filtered Extended = %q", a.Extended)
+	}
+}
+
+func TestTextMode(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	s := &session{fs: fs, newline: canonicalNewline}
+
+	f, e := fs.OpenFile("/t", SSH_FXF_WRITE|SSH_FXF_CREAT, &Attr{})
+	failOnErr(t, e, "OpenFile")
+	tf, e := s.openText(f, SSH_FXF_WRITE)
+	failOnErr(t, e, "openText")
+	// 偏移量被忽略, CRLF 可能被拆分到两次写入中
+	for _, w := range []string{"a\r\nb\r", "\nc\r\n", "\r"} {
+		_, e = tf.WriteAt([]byte(w), 1000)
+		failOnErr(t, e, "WriteAt")
+	}
+	failOnErr(t, tf.Close(), "Close")
+	bs, _ := ioutil.ReadFile(dir + "/t")
+	if string(bs) != "a\nb\nc\n\r" {
+		t.Fatalf("file contains %q", bs)
+	}
+
+	f, e = fs.OpenFile("/t", SSH_FXF_READ, &Attr{})
+	failOnErr(t, e, "OpenFile")
+	tf, e = s.openText(f, SSH_FXF_READ)
+	failOnErr(t, e, "openText")
+	defer tf.Close()
+	var got []byte
+	buf := make([]byte, 3)
+	for {
+		n, e := tf.ReadAt(buf, 0)
+		got = append(got, buf[:n]...)
+		if e == io.EOF {
+			break
+		}
+		failOnErr(t, e, "ReadAt")
+	}
+	if string(got) != "a\r\nb\r\nc\r\n\r" {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func TestTextHandleExtensions(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	failOnErr(t, ioutil.WriteFile(dir+"/t", []byte("a\nb\n"), 0644), "WriteFile")
+
+	var out strings.Builder
+	s := &session{fs: fs, out: &out, opts: (*Options)(nil).withDefaults(), newline: canonicalNewline}
+	s.h.Init()
+	defer s.h.CloseAll()
+	status := func() SSH_FX {
+		bs := []byte(out.String())
+		out.Reset()
+		return SSH_FX(bs[12])
+	}
+	open := func(name string, flags uint32) string {
+		f, e := fs.OpenFile(name, flags&^SSH_FXF_TEXT, &Attr{})
+		failOnErr(t, e, "OpenFile")
+		if flags&SSH_FXF_TEXT != 0 {
+			f, e = s.openText(f, flags)
+			failOnErr(t, e, "openText")
+		}
+		return s.h.newOpenFile(f, &openFile{path: name, flags: flags})
+	}
+	th := open("/t", SSH_FXF_READ|SSH_FXF_TEXT)
+	wh := open("/c", SSH_FXF_WRITE|SSH_FXF_CREAT)
+
+	// 文本模式句柄的偏移量不是文件的偏移量, 这两个扩展都不支持
+	bs := binp.Out().B32String(th).B32String("md5").B64(2).B64(0).B32(0).Out()
+	failOnErr(t, s.checkFileHandle(1, binp.NewParser(bs)), "checkFileHandle")
+	if code := status(); code != SSH_FX_OP_UNSUPPORTED {
+		t.Errorf("check-file-handle on a text handle: %v", code)
+	}
+	bs = binp.Out().B32String(th).B64(2).B64(0).B32String(wh).B64(0).Out()
+	failOnErr(t, s.copyData(1, binp.NewParser(bs)), "copyData")
+	if code := status(); code != SSH_FX_OP_UNSUPPORTED {
+		t.Errorf("copy-data from a text handle: %v", code)
+	}
+
+	// 读取仍然从头开始
+	buf := make([]byte, 16)
+	n, e := s.h.GetFile(th).ReadAt(buf, 0)
+	if e != nil && e != io.EOF || string(buf[:n]) != "a\r\nb\r\n" {
+		t.Errorf("read after the extensions: %q %v", buf[:n], e)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	failOnErr(t, ioutil.WriteFile(dir+"/f", []byte("0123456789"), 0644), "WriteFile")
+	locks := NewLockManager()
+	opts := &Options{Locks: locks}
+	cl := newTestClient(t, fs, opts)
+	defer cl.Close()
+
+	// 另一个会话的句柄对前 5 个字节加共享锁
+	other := &openFile{path: "/f", flags: SSH_FXF_READ | SSH_FXF_WRITE, key: newLockKey(fs, "/f"), locks: locks}
+	failOnErr(t, locks.open(other), "open")
+	failOnErr(t, locks.lock(other, 0, 5, SSH_FXF_BLOCK_WRITE), "lock")
+	f, e := cl.OpenFile("/f", os.O_RDWR)
+	failOnErr(t, e, "OpenFile")
+	defer f.Close()
+	writeAt := func(off int64) error {
+		f.Seek(off, io.SeekStart)
+		_, e := f.Write([]byte("x"))
+		return e
+	}
+	if writeAt(3) == nil {
+		t.Fatal("write into a locked range succeeded")
+	}
+	failOnErr(t, writeAt(5), "Write")
+	r, e := cl.Open("/f")
+	failOnErr(t, e, "Open")
+	_, e = r.Read(make([]byte, 5))
+	failOnErr(t, e, "Read")
+	r.Close()
+
+	mine := &openFile{path: "/f", flags: SSH_FXF_READ, key: newLockKey(fs, "f"), locks: locks}
+	failOnErr(t, locks.open(mine), "open")
+	failOnErr(t, locks.lock(mine, 2, 1, SSH_FXF_BLOCK_WRITE), "shared lock")
+	if statusCode(locks.lock(mine, 4, 0, SSH_FXF_BLOCK_READ|SSH_FXF_BLOCK_WRITE)) != SSH_FX_BYTE_RANGE_LOCK_CONFLICT {
+		t.Fatal("exclusive lock over a shared one")
+	}
+	if statusCode(locks.unlock(other, 0, 4)) != SSH_FX_NO_MATCHING_BYTE_RANGE_LOCK {
+		t.Fatal("unlocked a range that was not locked")
+	}
+	failOnErr(t, locks.unlock(other, 0, 5), "unlock")
+	failOnErr(t, writeAt(3), "Write")
+	mine.release()
+
+	// 打开时的 SSH_FXF_BLOCK_WRITE 和 SSH_FXF_BLOCK_DELETE
+	other.release()
+	other.block = SSH_FXF_BLOCK_WRITE | SSH_FXF_BLOCK_DELETE
+	if locks.open(other) == nil {
+		t.Fatal("blocked writes while the file is open for writing")
+	}
+	f.Close()
+	failOnErr(t, locks.open(other), "open")
+	if _, e = cl.OpenFile("/f", os.O_WRONLY); e == nil {
+		t.Fatal("opened a blocked file for writing")
+	}
+	r, e = cl.Open("/f")
+	failOnErr(t, e, "Open")
+	r.Close()
+	if cl.Remove("/f") == nil || cl.Rename("/f", "/g") == nil {
+		t.Fatal("removed a file blocked against deletion")
+	}
+	other.release()
+	failOnErr(t, cl.Remove("/f"), "Remove")
+
+	// LocalFs 可以同时加 fcntl 锁
+	failOnErr(t, ioutil.WriteFile(dir+"/g", nil, 0644), "WriteFile")
+	f1, e := fs.OpenFile("/g", SSH_FXF_READ|SSH_FXF_WRITE, &Attr{})
+	failOnErr(t, e, "OpenFile")
+	defer f1.Close()
+	f2, e := fs.OpenFile("/g", SSH_FXF_READ|SSH_FXF_WRITE, &Attr{})
+	failOnErr(t, e, "OpenFile")
+	defer f2.Close()
+	l1, ok := f1.(RangeLocker)
+	if !ok {
+		return
+	}
+	failOnErr(t, l1.Lock(0, 0, true), "Lock")
+	if statusCode(f2.(RangeLocker).Lock(10, 1, true)) != SSH_FX_BYTE_RANGE_LOCK_CONFLICT {
+		t.Fatal("fcntl locks do not conflict")
+	}
+	failOnErr(t, l1.Unlock(0, 0), "Unlock")
+	failOnErr(t, f2.(RangeLocker).Lock(10, 1, true), "Lock")
+}
+
+func TestNameCodec(t *testing.T) {
+	gbk := "\xd6\xd0\xce\xc4" // "中文"
+	if NameCodecGB18030.Decode(gbk) != "中文" || NameCodecGB18030.Encode("中文") != gbk {
+		t.Fatal("GB18030 conversion failed")
+	}
+	if NameCodecLatin1.Decode("caf\xe9") != "café" || NameCodecBig5.Decode("\xa4\xa4") != "中" {
+		t.Fatal("Latin-1 or Big5 conversion failed")
+	}
+	// 无法转换的文件名保持不变
+	if NameCodecShiftJIS.Encode("中文Ā") != "中文Ā" {
+		t.Fatal("unconvertible name was changed")
+	}
+	for locale, want := range map[string]NameCodec{
+		"zh_CN.GBK":        NameCodecGB18030,
+		"zh_TW.Big5":       NameCodecBig5,
+		"ja_JP.Shift_JIS":  NameCodecShiftJIS,
+		"ko_KR.euc-kr":     NameCodecEUCKR,
+		"de_DE.ISO-8859-1": NameCodecLatin1,
+		"en_US.UTF-8":      NameCodecUTF8,
+		"C":                nil,
+	} {
+		if NameCodecForLocale(locale) != want {
+			t.Fatalf("wrong codec for %s", locale)
+		}
+	}
+
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	cl := newTestClient(t, fs, &Options{NameCodec: NameCodecGB18030})
+	defer cl.Close()
+	f, e := cl.Create("/" + gbk)
+	failOnErr(t, e, "Create")
+	f.Close()
+	_, e = os.Stat(dir + "/中文")
+	failOnErr(t, e, "Stat")
+	fis, e := cl.ReadDir("/")
+	failOnErr(t, e, "ReadDir")
+	if len(fis) != 1 || fis[0].Name() != gbk {
+		t.Fatalf("listed %v", fis)
+	}
+	failOnErr(t, cl.Symlink(gbk, "/l"), "Symlink")
+	target, e := cl.ReadLink("/l")
+	failOnErr(t, e, "ReadLink")
+	if target != gbk {
+		t.Fatalf("link target %q", target)
+	}
+
+	// 默认按 GB18030 转换, 已经是 UTF-8 的文件名不变
+	if NameCodecGB18030.Decode("中文") != "中文" {
+		t.Fatal("UTF-8 name was decoded")
+	}
+	dcl := newTestClient(t, fs, nil)
+	defer dcl.Close()
+	failOnErr(t, dcl.Mkdir("/\xd5\xe2"), "Mkdir") // "这"
+	failOnErr(t, dcl.Mkdir("/文件"), "Mkdir")
+	for _, name := range []string{"这", "文件"} {
+		_, e = os.Stat(dir + "/" + name)
+		failOnErr(t, e, "Stat")
+	}
+	// 发送的文件名总是 GB18030, UTF-8 客户端上传的文件名列出时不再是 UTF-8
+	listed := func(cl *client.Client, name string) bool {
+		fis, e := cl.ReadDir("/")
+		failOnErr(t, e, "ReadDir")
+		for _, fi := range fis {
+			if fi.Name() == name {
+				return true
+			}
+		}
+		return false
+	}
+	if !listed(dcl, NameCodecGB18030.Encode("文件")) {
+		t.Fatal("UTF-8 name not listed in GB18030")
+	}
+	ucl := newTestClient(t, fs, &Options{NameCodec: NameCodecUTF8})
+	defer ucl.Close()
+	if !listed(ucl, "文件") {
+		t.Fatal("UTF-8 name not listed with NameCodecUTF8")
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	var (
+		mu  sync.Mutex
+		ops []string
+	)
+	record := func(c *Call, next Invoker) error {
+		e := next(c)
+		mu.Lock()
+		ops = append(ops, c.Op.String()+" "+c.Path)
+		mu.Unlock()
+		return e
+	}
+	veto := func(c *Call, next Invoker) error {
+		if (c.Op == OpRemove || c.Op == OpRmdir) && c.Path == "/keep" {
+			return NewStatusError(SSH_FX_PERMISSION_DENIED, "keep")
+		}
+		// 把 /alias 改为 /real
+		if c.Path == "/alias" {
+			c.Path = "/real"
+		}
+		return next(c)
+	}
+	cl := newTestClient(t, fs, &Options{Interceptors: []Interceptor{record, veto}})
+	defer cl.Close()
+
+	failOnErr(t, ioutil.WriteFile(dir+"/keep", nil, 0644), "WriteFile")
+	if cl.Remove("/keep") == nil {
+		t.Fatal("vetoed remove succeeded")
+	}
+	f, e := cl.Create("/alias")
+	failOnErr(t, e, "Create")
+	_, e = f.Write([]byte("data"))
+	failOnErr(t, e, "Write")
+	f.Close()
+	bs, e := ioutil.ReadFile(dir + "/real")
+	failOnErr(t, e, "ReadFile")
+	if string(bs) != "data" {
+		t.Fatalf("real contains %q", bs)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"Remove /keep", "OpenFile /real", "Write /real", "Close /real"}
+	for _, w := range want {
+		found := false
+		for _, op := range ops {
+			found = found || op == w
+		}
+		if !found {
+			t.Fatalf("%q not intercepted in %v", w, ops)
+		}
+	}
+}
+
+// closingFs tells when the server closes it.
+type closingFs struct {
+	*LocalFs
+	closed chan struct{}
+}
+
+func (fs closingFs) Close() error {
+	close(fs.closed)
+	return nil
+}
+
+func TestFileSystemFor(t *testing.T) {
+	dir, e := ioutil.TempDir("", "sftpd-test")
+	failOnErr(t, e, "TempDir")
+	defer os.RemoveAll(dir)
+	failOnErr(t, os.Mkdir(dir+"/alice", 0755), "Mkdir")
+	failOnErr(t, ioutil.WriteFile(dir+"/alice/mine", nil, 0644), "WriteFile")
+
+	hkey, e := sshutil.KeyLoader{Flags: sshutil.Create}.Load()
+	failOnErr(t, e, "Failed to parse host key")
+	closed := make(chan struct{})
+	config := &Config{LogFunc: func(...interface{}) {}}
+	config.PasswordCallback = func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+		return &ssh.Permissions{Extensions: map[string]string{"root": dir + "/" + conn.User() + "/"}}, nil
+	}
+	config.AddHostKey(hkey)
+	config.FileSystemFor = func(conn ssh.ConnMetadata, perms *ssh.Permissions) (FileSystem, error) {
+		return closingFs{NewLocalFs(perms.Extensions["root"]), closed}, nil
+	}
+
+	listener, e := net.Listen("tcp", "127.0.0.1:0")
+	failOnErr(t, e, "Listen")
+	defer listener.Close()
+	go func() {
+		if sconn, e := listener.Accept(); e == nil {
+			handleConn(sconn, config)
+		}
+	}()
+	cconn, e := net.Dial("tcp", listener.Addr().String())
+	failOnErr(t, e, "Dial")
+	cc := &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.Password("x")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	c, chans, reqs, e := ssh.NewClientConn(cconn, "pipe", cc)
+	failOnErr(t, e, "NewClientConn")
+	conn := ssh.NewClient(c, chans, reqs)
+	cl, e := client.NewClient(conn)
+	failOnErr(t, e, "NewClient")
+	_, e = cl.Stat("/mine")
+	failOnErr(t, e, "Stat")
+	cl.Close()
+	conn.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("file system not closed with the connection")
+	}
+}
+
+func TestFileSystemForNil(t *testing.T) {
+	hkey, e := sshutil.KeyLoader{Flags: sshutil.Create}.Load()
+	failOnErr(t, e, "Failed to parse host key")
+	logged := make(chan string, 1)
+	config := &Config{LogFunc: func(v ...interface{}) { logged <- fmt.Sprint(v...) }}
+	config.PasswordCallback = func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+		return nil, nil
+	}
+	config.AddHostKey(hkey)
+	config.FileSystemFor = func(conn ssh.ConnMetadata, perms *ssh.Permissions) (FileSystem, error) {
+		return nil, nil
+	}
+
+	listener, e := net.Listen("tcp", "127.0.0.1:0")
+	failOnErr(t, e, "Listen")
+	defer listener.Close()
+	go func() {
+		if sconn, e := listener.Accept(); e == nil {
+			handleConn(sconn, config)
+		}
+	}()
+	cconn, e := net.Dial("tcp", listener.Addr().String())
+	failOnErr(t, e, "Dial")
+	cc := &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            []ssh.AuthMethod{ssh.Password("x")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	c, chans, reqs, e := ssh.NewClientConn(cconn, "pipe", cc)
+	failOnErr(t, e, "NewClientConn")
+	conn := ssh.NewClient(c, chans, reqs)
+	defer conn.Close()
+	// 没有文件系统时关闭连接, 而不是在第一个请求时 panic
+	if cl, e := client.NewClient(conn); e == nil {
+		cl.Close()
+		t.Fatal("session started without a file system")
+	}
+	select {
+	case msg := <-logged:
+		if !strings.Contains(msg, "no file system") {
+			t.Fatalf("logged %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection error not logged")
+	}
+}
+
+// resolveModes are the ways LocalFs resolves paths beneath its root, each
+// sets its way up and returns a function that restores the default.
+var resolveModes = map[string]func() func(){
+	"default": func() func() { return func() {} },
+}
+
+func TestConfinement(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	outside, e := ioutil.TempDir("", "sftpd-outside")
+	failOnErr(t, e, "TempDir")
+	defer os.RemoveAll(outside)
+	failOnErr(t, ioutil.WriteFile(outside+"/secret", []byte("s"), 0600), "WriteFile")
+	failOnErr(t, ioutil.WriteFile(dir+"/release..notes.txt", []byte("n"), 0644), "WriteFile")
+	failOnErr(t, os.Mkdir(dir+"/d", 0755), "Mkdir")
+	for link, target := range map[string]string{
+		"/out":     outside,
+		"/rel":     "../" + path.Base(outside),
+		"/d/deep":  "../../" + path.Base(outside) + "/secret",
+		"/abs":     outside + "/secret",
+		"/loop":    "loop",
+		"/d/notes": "../release..notes.txt",
+	} {
+		failOnErr(t, os.Symlink(target, dir+link), "Symlink")
+	}
+
+	for walk, setup := range resolveModes {
+		restore := setup()
+		cl := newTestClient(t, fs, nil)
+		for _, p := range []string{"/out/secret", "/rel/secret", "/d/deep", "/abs", "/loop"} {
+			if _, e := cl.Stat(p); e == nil {
+				t.Errorf("walk %s: stat %s escaped the root", walk, p)
+			}
+			if f, e := cl.Open(p); e == nil {
+				f.Close()
+				t.Errorf("walk %s: open %s escaped the root", walk, p)
+			}
+		}
+		if _, e := cl.ReadDir("/out"); e == nil {
+			t.Errorf("walk %s: readdir escaped the root", walk)
+		}
+		if f, e := cl.Create("/out/new"); e == nil {
+			f.Close()
+			t.Errorf("walk %s: create escaped the root", walk)
+		}
+		if cl.Mkdir("/rel/new") == nil || cl.Chmod("/abs", 0666) == nil || cl.Rename("/d/notes", "/out/moved") == nil {
+			t.Errorf("walk %s: change escaped the root", walk)
+		}
+		if _, e := os.Lstat(outside + "/new"); e == nil {
+			t.Errorf("walk %s: file created outside of the root", walk)
+		}
+		if fi, _ := os.Stat(outside + "/secret"); fi.Mode().Perm() != 0600 {
+			t.Errorf("walk %s: secret mode changed to %v", walk, fi.Mode())
+		}
+
+		// 链接本身和名字里带 ".." 的文件仍然可以访问
+		_, e := cl.Lstat("/abs")
+		failOnErr(t, e, "Lstat")
+		for _, p := range []string{"/release..notes.txt", "/d/notes", "/d/../release..notes.txt"} {
+			f, e := cl.Open(p)
+			failOnErr(t, e, "Open "+p)
+			bs, e := ioutil.ReadAll(f)
+			f.Close()
+			if e != nil || string(bs) != "n" {
+				t.Errorf("walk %s: read %s: %q %v", walk, p, bs, e)
+			}
+		}
+		// 修改属性时跟随根目录内的链接
+		failOnErr(t, cl.Chmod("/d/notes", 0640), "Chmod")
+		if fi, _ := os.Lstat(dir + "/release..notes.txt"); fi.Mode().Perm() != 0640 {
+			t.Errorf("walk %s: chmod through a link: mode %v", walk, fi.Mode())
+		}
+		failOnErr(t, os.Chmod(dir+"/release..notes.txt", 0644), "Chmod")
+		cl.Close()
+		restore()
+	}
+
+	// 根目录没有结尾的 "/" 时也不能访问名字以它开头的兄弟目录
+	failOnErr(t, os.MkdirAll(dir+"/subfoo", 0755), "MkdirAll")
+	failOnErr(t, os.Mkdir(dir+"/sub", 0755), "Mkdir")
+	failOnErr(t, ioutil.WriteFile(dir+"/subfoo/x", []byte("x"), 0644), "WriteFile")
+	if _, e := NewLocalFs(dir+"/sub").Stat("foo/x", false); e == nil {
+		t.Error("root without a trailing slash reached a sibling")
+	}
+	_, e = NewLocalFs(dir).Stat("/subfoo/x", false)
+	failOnErr(t, e, "Stat")
+}
+
+func TestAttrFidelity(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	cl := newTestClient(t, fs, nil)
+	defer cl.Close()
+
+	// 读写同时打开的文件既能写也能读
+	f, e := cl.OpenFile("/rw", os.O_RDWR|os.O_CREATE)
+	failOnErr(t, e, "OpenFile")
+	_, e = f.Write([]byte("hello"))
+	failOnErr(t, e, "Write")
+	_, e = f.Seek(0, io.SeekStart)
+	failOnErr(t, e, "Seek")
+	bs := make([]byte, 5)
+	_, e = io.ReadFull(f, bs)
+	if e != nil || string(bs) != "hello" {
+		t.Fatalf("read back %q: %v", bs, e)
+	}
+	failOnErr(t, f.Truncate(4), "FSETSTAT size")
+	failOnErr(t, f.Chmod(0640), "FSETSTAT mode")
+	f.Close()
+
+	// 只修改客户端要求的属性
+	before, e := cl.Stat("/rw")
+	failOnErr(t, e, "Stat")
+	failOnErr(t, cl.Chmod("/rw", 0600), "Chmod")
+	after, e := cl.Stat("/rw")
+	failOnErr(t, e, "Stat")
+	if after.Mode().Perm() != 0600 || after.Size() != 4 {
+		t.Errorf("after chmod: mode %v size %d", after.Mode(), after.Size())
+	}
+	if b, a := before.Sys().(*client.FileStat), after.Sys().(*client.FileStat); a.UID != b.UID || a.GID != b.GID || a.Mtime != b.Mtime {
+		t.Errorf("chmod changed %+v to %+v", b, a)
+	}
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	failOnErr(t, cl.Chtimes("/rw", mtime, mtime), "Chtimes")
+	failOnErr(t, cl.Truncate("/rw", 2), "Truncate")
+	fi, e := os.Stat(dir + "/rw")
+	failOnErr(t, e, "Stat")
+	if fi.Size() != 2 || fi.Mode().Perm() != 0600 {
+		t.Errorf("rw: size %d mode %v", fi.Size(), fi.Mode())
+	}
+	failOnErr(t, os.Chtimes(dir+"/rw", mtime, mtime), "Chtimes")
+	failOnErr(t, fs.SetStat("/rw", &Attr{Flags: ATTR_TIME, MTime: mtime.Add(time.Hour)}), "SetStat")
+	if fi, _ = os.Stat(dir + "/rw"); !fi.ModTime().Equal(mtime.Add(time.Hour)) {
+		t.Errorf("mtime %v", fi.ModTime())
+	}
+
+	// 新建的文件和目录使用请求中的权限
+	nf, e := fs.OpenFile("/new", SSH_FXF_WRITE|SSH_FXF_CREAT, &Attr{Flags: ATTR_MODE, Mode: 0600})
+	failOnErr(t, e, "OpenFile")
+	nf.Close()
+	failOnErr(t, fs.Mkdir("/d", &Attr{Flags: ATTR_MODE | ATTR_TIME, Mode: 0700, ATime: mtime, MTime: mtime}), "Mkdir")
+	failOnErr(t, fs.Mkdir("/e", &Attr{}), "Mkdir")
+	for p, want := range map[string]os.FileMode{"/new": 0600, "/d": 0700} {
+		if fi, e := os.Stat(dir + p); e != nil || fi.Mode().Perm() != want {
+			t.Errorf("%s: %v %v, want %v", p, fi.Mode(), e, want)
+		}
+	}
+	if fi, e := os.Stat(dir + "/d"); e != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("/d mtime %v", fi.ModTime())
+	}
+	if fi, e := os.Stat(dir + "/e"); e != nil || fi.Mode().Perm()&0700 != 0700 {
+		t.Errorf("/e created with %v", fi.Mode())
+	}
+}
+
+func TestRecursiveRemove(t *testing.T) {
+	fs, dir := newTestLocalFs(t)
+	defer os.RemoveAll(dir)
+	outside, e := ioutil.TempDir("", "sftpd-outside")
+	failOnErr(t, e, "TempDir")
+	defer os.RemoveAll(outside)
+	failOnErr(t, ioutil.WriteFile(outside+"/x", []byte("x"), 0644), "WriteFile")
+	for _, d := range []string{"/t/sub/deeper", "/t/keep", "/empty"} {
+		failOnErr(t, os.MkdirAll(dir+d, 0755), "MkdirAll")
+	}
+	for _, f := range []string{"/t/a", "/t/sub/b", "/t/sub/deeper/c", "/t/keep/x"} {
+		failOnErr(t, ioutil.WriteFile(dir+f, []byte(f), 0644), "WriteFile")
+	}
+	failOnErr(t, os.Symlink(outside, dir+"/t/link"), "Symlink")
+
+	// SSH_FXP_RMDIR 只删除空目录
+	cl := newTestClient(t, fs, nil)
+	if cl.RemoveDirectory("/t") == nil || cl.RemoveDirectory("/t/a") == nil {
+		t.Fatal("rmdir removed a non-empty directory or a file")
+	}
+	failOnErr(t, cl.RemoveDirectory("/empty"), "RemoveDirectory")
+	cl.Close()
+
+	if has := func(opts *Options) bool {
+		s := &session{fs: fs, opts: opts.withDefaults()}
+		return strings.Contains(strings.Join(s.announcedExtensions(), " "), "rmdir-recursive@sftpd")
+	}; has(nil) || !has(&Options{RecursiveRemove: true}) {
+		t.Fatal("rmdir-recursive@sftpd not announced only when enabled")
+	}
+
+	veto := func(c *Call, next Invoker) error {
+		if c.Op == OpRemove && c.Path == "/t/keep/x" {
+			return NewStatusError(SSH_FX_PERMISSION_DENIED, "keep")
+		}
+		return next(c)
+	}
+	var out strings.Builder
+	s := &session{fs: Intercept(fs, nil, veto), out: &out, version: 3, opts: (&Options{RecursiveRemove: true}).withDefaults()}
+	failOnErr(t, s.rmdirRecursive(5, binp.NewParser(binp.Out().B32String("/t").Out())), "rmdirRecursive")
+	var (
+		plen, id, count, code uint32
+		op                    byte
+		p, msg                string
+	)
+	e = binp.NewParser([]byte(out.String())).B32(&plen).Byte(&op).B32(&id).B32(&count).B32String(&p).B32(&code).B32String(&msg).End()
+	failOnErr(t, e, "parse reply")
+	if op != SSH_FXP_EXTENDED_REPLY || count != 1 || p != "/t/keep/x" || code != uint32(SSH_FX_PERMISSION_DENIED) || msg != "keep" {
+		t.Fatalf("bad reply %d %d %q %d %q", op, count, p, code, msg)
+	}
+	for _, gone := range []string{"/t/a", "/t/sub", "/t/link"} {
+		if _, e := os.Lstat(dir + gone); !os.IsNotExist(e) {
+			t.Errorf("%s not removed: %v", gone, e)
+		}
+	}
+	if _, e := os.Stat(outside + "/x"); e != nil {
+		t.Error("followed a symbolic link out of the tree")
+	}
+
+	out.Reset()
+	s.fs = fs
+	failOnErr(t, s.rmdirRecursive(6, binp.NewParser(binp.Out().B32String("/t").Out())), "rmdirRecursive")
+	binp.NewParser([]byte(out.String())).B32(&plen).Byte(&op).B32(&id).B32(&code)
+	if op != SSH_FXP_STATUS || code != uint32(SSH_FX_OK) {
+		t.Fatalf("bad reply %d %d", op, code)
+	}
+	if _, e := os.Lstat(dir + "/t"); !os.IsNotExist(e) {
+		t.Errorf("/t not removed: %v", e)
+	}
+}
+
+func TestIdentityResolvers(t *testing.T) {
+	dir, e := ioutil.TempDir("", "sftpd-ids")
+	failOnErr(t, e, "TempDir")
+	defer os.RemoveAll(dir)
+	write := func(passwd string) {
+		failOnErr(t, ioutil.WriteFile(dir+"/passwd", []byte(passwd), 0644), "WriteFile")
+		failOnErr(t, ioutil.WriteFile(dir+"/group", []byte("staff:x:50:\n"), 0644), "WriteFile")
+	}
+	write("alice:x:1000:1000::/home/alice:/bin/sh\n")
+	// 发送到 gate 的通道关闭之前, 下一次读取一直等待
+	gate := make(chan chan struct{}, 1)
+	r := newFileResolver(func(name string) (io.ReadCloser, error) {
+		select {
+		case g := <-gate:
+			<-g
+		default:
+		}
+		return os.Open(dir + "/" + path.Base(name))
+	}, 50*time.Millisecond)
+	if r.UserName(1000) != "alice" || r.GroupName(50) != "staff" || r.UserName(1001) != "" {
+		t.Fatalf("got %q %q %q", r.UserName(1000), r.GroupName(50), r.UserName(1001))
+	}
+	// 过期之前使用缓存, 过期之后重新读取
+	write("bob:x:1000:1000::/home/bob:/bin/sh\n")
+	if r.UserName(1000) != "alice" {
+		t.Fatal("cache not used")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if r.UserName(1000) != "bob" {
+		t.Fatal("cache not refreshed")
+	}
+
+	// 重新读取时其他查询不等待, 继续使用之前的结果
+	write("carol:x:1000:1000::/home/carol:/bin/sh\n")
+	time.Sleep(60 * time.Millisecond)
+	g := make(chan struct{})
+	gate <- g
+	refreshed := make(chan string)
+	go func() { refreshed <- r.UserName(1000) }()
+	for len(gate) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	looked := make(chan string)
+	go func() { looked <- r.UserName(1000) }()
+	select {
+	case name := <-looked:
+		if name != "bob" {
+			t.Fatalf("lookup during the refresh got %q", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup waited for the refresh")
+	}
+	close(g)
+	if name := <-refreshed; name != "carol" {
+		t.Fatalf("refresh got %q", name)
+	}
+
+	// 服务端提供的解析器优先于 FileSystem 的
+	v := &VirtualResolver{Users: map[uint32]string{0: "admin"}, User: "carol", Group: "users"}
+	s := &session{fs: EmptyFS{}, opts: (&Options{Identities: v}).withDefaults()}
+	a := NamedAttr{Name: "f", Attr: Attr{Flags: ATTR_UIDGID, Uid: 0, Gid: 7}}
+	s.fillNames(&a.Attr)
+	if a.User != "admin" || a.Group != "users" || !hasIdentities(s) {
+		t.Fatalf("virtual names %q %q", a.User, a.Group)
+	}
+	if ln := s.opts.LongNameFormatter.LongName(&a); !strings.Contains(ln, " admin ") || !strings.Contains(ln, " users ") {
+		t.Errorf("long name %q", ln)
+	}
+	b := NamedAttr{Name: "g", Attr: Attr{Flags: ATTR_UIDGID, Uid: 4242, Gid: 4343}}
+	if ln := s.opts.LongNameFormatter.LongName(&b); !strings.Contains(ln, " 4242 ") || !strings.Contains(ln, " 4343 ") {
+		t.Errorf("long name without names %q", ln)
+	}
+
+	// 版本 4 以上按名字设置属主, 解析不了的名字不能当作成功
+	v.Groups = map[uint32]string{100: "users"}
+	set := Attr{User: "admin", Group: "users"}
+	failOnErr(t, s.ownerIDs(&set), "ownerIDs")
+	if set.Flags&ATTR_UIDGID == 0 || set.Uid != 0 || set.Gid != 100 {
+		t.Errorf("owner by name %+v", set)
+	}
+	set = Attr{User: "1001", Group: "users"}
+	failOnErr(t, s.ownerIDs(&set), "ownerIDs")
+	if set.Uid != 1001 || set.Gid != 100 {
+		t.Errorf("numeric owner %+v", set)
+	}
+	if e := s.ownerIDs(&Attr{User: "nobody-here", Group: "users"}); statusCode(e) != SSH_FX_OWNER_INVALID {
+		t.Errorf("unknown owner: %v", e)
+	}
+	e = s.checkCall(&Call{Op: OpSetStat, Path: "/f", Attr: &Attr{User: "admin", Group: "nogroup"}}, func(*Call) error {
+		t.Error("setstat with an unknown group was passed on")
+		return nil
+	})
+	if statusCode(e) != SSH_FX_GROUP_INVALID {
+		t.Errorf("unknown group: %v", e)
+	}
+	var lk IdentityLookup = r
+	if uid, ok := lk.UserID("carol"); !ok || uid != 1000 {
+		t.Errorf("UserID(carol) = %d %v", uid, ok)
+	}
+}
+
+func TestLongNames(t *testing.T) {
+	old := time.Date(2001, 2, 3, 20, 5, 0, 0, time.UTC)
+	file := NamedAttr{Name: "a.txt", Attr: Attr{Flags: ATTR_UIDGID, ModeString: "-rw-r--r--", User: "alice", Group: "staff", Size: 1234, MTime: old}, Nlink: 2}
+	link := NamedAttr{Name: "l", Attr: Attr{Flags: ATTR_UIDGID, Mode: os.ModeSymlink | 0777, ModeString: "lrwxrwxrwx", Uid: 1001, Gid: 1002, Size: 5, MTime: old}, Link: "a.txt"}
+	dir := NamedAttr{Name: "d", Attr: Attr{Mode: os.ModeDir | 0755, ModeString: "drwxr-xr-x", MTime: old}}
+	cst := time.FixedZone("CST", 8*3600)
+	var months [12]string
+	for i := range months {
+		months[i] = strconv.Itoa(i+1) + "月"
+	}
+	for _, c := range []struct {
+		f    LongNameFormatter
+		fi   *NamedAttr
+		want string
+	}{
+		{LsFormatter{Location: time.UTC}, &file, "-rw-r--r--    2 alice    staff        1234 Feb  3  2001 a.txt"},
+		{LsFormatter{Location: cst, Months: months}, &file, "-rw-r--r--    2 alice    staff        1234 2月  4  2001 a.txt"},
+		{LsFormatter{Location: time.UTC}, &link, "lrwxrwxrwx    1 1001     1002            5 Feb  3  2001 l -> a.txt"},
+		{LsFormatter{Location: time.UTC}, &dir, "drwxr-xr-x    1 -        -               0 Feb  3  2001 d"},
+		{WindowsFormatter{Location: time.UTC}, &file, "2001/02/03  20:05             1,234 a.txt"},
+		{WindowsFormatter{Location: cst}, &dir, "2001/02/04  04:05    <DIR>          d"},
+		{WindowsFormatter{Location: time.UTC}, &link, "2001/02/03  20:05    <SYMLINK>      l [a.txt]"},
+		{MinimalFormatter{}, &file, "a.txt"},
+	} {
+		if got := c.f.LongName(c.fi); got != c.want {
+			t.Errorf("%T: got\n%q, want\n%q", c.f, got, c.want)
+		}
+	}
+	// 默认使用服务器的本地时间
+	recent := file
+	recent.MTime = time.Now().Add(-time.Hour)
+	if got, want := (LsFormatter{}).LongName(&recent), recent.MTime.Local().Format("15:04")+" a.txt"; !strings.HasSuffix(got, want) {
+		t.Errorf("recent file %q", got)
+	}
+
+	// LocalFs 给出真实的链接数和软链接目标
+	fs, tmp := newTestLocalFs(t)
+	defer os.RemoveAll(tmp)
+	failOnErr(t, ioutil.WriteFile(tmp+"/f", []byte("f"), 0644), "WriteFile")
+	failOnErr(t, os.Link(tmp+"/f", tmp+"/g"), "Link")
+	failOnErr(t, os.Symlink("f", tmp+"/s"), "Symlink")
+	d, e := fs.OpenDir("/")
+	failOnErr(t, e, "OpenDir")
+	defer d.Close()
+	nas, e := d.Readdir(0, Handles{})
+	failOnErr(t, e, "Readdir")
+	for _, na := range nas {
+		switch na.Name {
+		case "f", "g":
+			if na.Nlink != 2 {
+				t.Errorf("%s has %d links", na.Name, na.Nlink)
+			}
+		case "s":
+			if na.Link != "f" {
+				t.Errorf("symlink target %q", na.Link)
+			}
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -14,7 +15,9 @@ import (
 )
 
 func NewSftpFile(file *sftp.File) *SftpFile {
-	return &SftpFile{file: file}
+	sf := &SftpFile{file: file, turn: make(chan struct{}, 1)}
+	sf.turn <- struct{}{}
+	return sf
 }
 
 func NewSftpDir(client *sftp.Client, path string) *SftpDir {
@@ -22,57 +25,235 @@ func NewSftpDir(client *sftp.Client, path string) *SftpDir {
 }
 
 func NewSftpFs(client *sftp.Client) *sftpFs {
-	return &sftpFs{client: client}
+	return &sftpFs{client: client, ids: NewSftpResolver(client, DefaultIdentityTTL)}
 }
 
+// NewSftpResolver returns an IdentityResolver that reads /etc/passwd and
+// /etc/group of an upstream sftp server again after ttl, ttl <= 0 means
+// DefaultIdentityTTL. Upstreams that are not unix like or do not let the
+// user read them leave the owners unknown.
+func NewSftpResolver(client *sftp.Client, ttl time.Duration) IdentityResolver {
+	return newFileResolver(func(name string) (io.ReadCloser, error) {
+		return client.Open(name)
+	}, ttl)
+}
+
+// maxSftpReaders limits the extra upstream handles a SftpFile opens to
+// serve concurrent reads.
+const maxSftpReaders = 7
+
+// SftpFile is safe for concurrent use. A *sftp.File has a single offset, so
+// each read or write takes the turn of file for its Seek and Read/Write.
+// Reads that find file busy use more read only handles of the same upstream
+// file, opened by name and only kept when they stat like file. Once the
+// file is written or its attributes are set all reads go through file.
 type SftpFile struct {
 	file *sftp.File
+	turn chan struct{}
+	// client is set by sftpFs for the requests that go by name.
+	client *sftp.Client
+
+	mu        sync.Mutex
+	readers   []*sftp.File
+	nreaders  int
+	noReaders bool
 }
 
 func (sf *SftpFile) Close() error {
+	sf.dropReaders()
 	return sf.file.Close()
 }
 
 func (sf *SftpFile) ReadAt(bs []byte, pos int64) (int, error) {
-	// 设置光标位置 offset,偏移量, whence，从哪开始：0从头，1当前，2末尾
-	_, err := sf.file.Seek(pos, 0)
-	if err != nil {
-		return 0, err
+	select {
+	case <-sf.turn:
+		defer func() { sf.turn <- struct{}{} }()
+		return sftpReadAt(sf.file, bs, pos)
+	default:
+	}
+	if r := sf.reader(); r != nil {
+		defer sf.putReader(r)
+		return sftpReadAt(r, bs, pos)
 	}
-	return sf.file.Read(bs)
+	<-sf.turn
+	defer func() { sf.turn <- struct{}{} }()
+	return sftpReadAt(sf.file, bs, pos)
 }
 
 func (sf *SftpFile) WriteAt(bs []byte, pos int64) (int, error) {
+	sf.dropReaders()
+	<-sf.turn
+	defer func() { sf.turn <- struct{}{} }()
 	// 设置光标位置 offset,偏移量, whence，从哪开始：0从头，1当前，2末尾
-	_, err := sf.file.Seek(pos, 0)
-	if err != nil {
-		return 0, err
+	_, e := sf.file.Seek(pos, 0)
+	if e != nil {
+		return 0, e
 	}
 	return sf.file.Write(bs)
 }
 
+func sftpReadAt(f *sftp.File, bs []byte, pos int64) (int, error) {
+	// 设置光标位置 offset,偏移量, whence，从哪开始：0从头，1当前，2末尾
+	_, e := f.Seek(pos, 0)
+	if e != nil {
+		return 0, e
+	}
+	return f.Read(bs)
+}
+
+// reader returns an idle extra handle or opens one, nil when there is none.
+func (sf *SftpFile) reader() *sftp.File {
+	sf.mu.Lock()
+	if n := len(sf.readers); n > 0 {
+		r := sf.readers[n-1]
+		sf.readers = sf.readers[:n-1]
+		sf.mu.Unlock()
+		return r
+	}
+	if sf.client == nil || sf.noReaders || sf.nreaders >= maxSftpReaders {
+		sf.mu.Unlock()
+		return nil
+	}
+	sf.nreaders++
+	sf.mu.Unlock()
+	r, e := sf.openReader()
+	if e != nil {
+		// 上游的文件已经改名或者被替换, 不再打开新的句柄
+		sf.mu.Lock()
+		sf.nreaders--
+		sf.noReaders = true
+		sf.mu.Unlock()
+		return nil
+	}
+	return r
+}
+
+// openReader opens the upstream file by name again and checks that it still
+// is the file behind sf.file.
+func (sf *SftpFile) openReader() (*sftp.File, error) {
+	r, e := sf.client.Open(sf.file.Name())
+	if e != nil {
+		return nil, e
+	}
+	fi, e := sf.file.Stat()
+	if e == nil {
+		var ri os.FileInfo
+		ri, e = r.Stat()
+		if e == nil && !sameSftpFile(fi, ri) {
+			e = errors.New("upstream file changed")
+		}
+	}
+	if e != nil {
+		r.Close()
+		return nil, e
+	}
+	return r, nil
+}
+
+func (sf *SftpFile) putReader(r *sftp.File) {
+	sf.mu.Lock()
+	if sf.noReaders {
+		sf.nreaders--
+		sf.mu.Unlock()
+		r.Close()
+		return
+	}
+	sf.readers = append(sf.readers, r)
+	sf.mu.Unlock()
+}
+
+// dropReaders closes the idle extra handles and keeps new ones from being
+// opened, busy ones are closed when they are put back.
+func (sf *SftpFile) dropReaders() {
+	sf.mu.Lock()
+	sf.noReaders = true
+	idle := sf.readers
+	sf.readers = nil
+	sf.nreaders -= len(idle)
+	sf.mu.Unlock()
+	for _, r := range idle {
+		r.Close()
+	}
+}
+
+// sameSftpFile tells whether two stats of upstream files look like the same
+// file, sftp has no inode numbers.
+func sameSftpFile(a, b os.FileInfo) bool {
+	if a.Size() != b.Size() || a.Mode() != b.Mode() || !a.ModTime().Equal(b.ModTime()) {
+		return false
+	}
+	as, aok := a.Sys().(*sftp.FileStat)
+	bs, bok := b.Sys().(*sftp.FileStat)
+	return aok == bok && (!aok || as.UID == bs.UID && as.GID == bs.GID)
+}
+
 func (sf *SftpFile) FStat() (*Attr, error) {
 	var a Attr
 	fi, e := sf.file.Stat()
 	if e != nil {
 		return nil, e
 	}
-	a.FillFrom(fi, 2)
+	a.FillFrom(fi)
 	return &a, nil
 }
 
 func (sf *SftpFile) FSetStat(a *Attr) error {
-	e := sf.file.Chmod(a.Mode)
-	if e != nil {
-		return e
+	sf.dropReaders()
+	var e error
+	if a.Flags & ATTR_SIZE != 0 {
+		e = sf.file.Truncate(int64(a.Size))
+		if e != nil {
+			return e
+		}
 	}
-	sysType := runtime.GOOS
-	if sysType != "windows" {	// windows 不支持 chown 操作
+	if a.Flags & ATTR_MODE != 0 {
+		e = sf.file.Chmod(a.Mode)
+		if e != nil {
+			return e
+		}
+	}
+	if a.Flags & ATTR_UIDGID != 0 && runtime.GOOS != "windows" {	// windows 不支持 chown 操作
 		e = sf.file.Chown(int(a.Uid), int(a.Gid))
+		if e != nil {
+			return e
+		}
+	}
+	if a.Flags & ATTR_TIME != 0 {
+		if sf.client == nil {
+			return errors.New("changing times needs a file opened by sftpFs")
+		}
+		e = sftpChtimes(sf.client, sf.file.Name(), a)
 	}
 	return e
 }
 
+func (sf *SftpFile) FStatVFS() (*StatVFS, error) {
+	if sf.client == nil {
+		return nil, errors.New("fstatvfs needs a file opened by sftpFs")
+	}
+	st, e := sf.client.StatVFS(sf.file.Name())
+	if e != nil {
+		return nil, e
+	}
+	return sftpStatVFS(st), nil
+}
+
+func sftpStatVFS(st *sftp.StatVFS) *StatVFS {
+	return &StatVFS{
+		Bsize:   st.Bsize,
+		Frsize:  st.Frsize,
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Favail:  st.Favail,
+		Fsid:    st.Fsid,
+		Flag:    st.Flag,
+		Namemax: st.Namemax,
+	}
+}
+
 type SftpDir struct {
 	client *sftp.Client
 	path string
@@ -91,7 +272,11 @@ func (sd *SftpDir) Readdir(count int, handles Handles) ([]NamedAttr, error) {
 	rs := make([]NamedAttr, len(fis))
 	for i, fi := range fis {
 		rs[i].Name = fi.Name()
-		rs[i].FillFrom(fi, 2)
+		rs[i].FillFrom(fi)
+		rs[i].Nlink = linkCount(fi)
+		if fi.Mode() & os.ModeSymlink != 0 {
+			rs[i].Link, _ = sd.client.ReadLink(path.Join(sd.path, fi.Name()))
+		}
 	}
 	return rs, nil
 }
@@ -102,6 +287,8 @@ func (sd *SftpDir) Close() error {
 
 type sftpFs struct {
 	client *sftp.Client
+	// 按上游的 /etc/passwd 和 /etc/group 解析用户和组
+	ids IdentityResolver
 }
 
 func (sfs *sftpFs) Stat(path string, isLstat bool) (*Attr, error) {
@@ -117,41 +304,33 @@ func (sfs *sftpFs) Stat(path string, isLstat bool) (*Attr, error) {
 		return nil, e
 	}
 	var a Attr
-	a.FillFrom(fi, 2)
+	a.FillFrom(fi)
 	return &a, nil
 }
 
 func (sfs *sftpFs) OpenFile(path string, mode uint32, a *Attr) (File, error) {
-	var (
-		f *sftp.File
-		flag int
-		e error
-	)
-	if mode & SSH_FXF_READ != 0 {
-		flag |= os.O_RDONLY
-	}
-	if mode & SSH_FXF_WRITE != 0 {
-		flag |= os.O_WRONLY
-	}
-	if mode & SSH_FXF_APPEND != 0 {
-		flag |= os.O_APPEND
-	}
-	if mode & SSH_FXF_CREAT != 0 {
-		flag |= os.O_CREATE
-	}
-	if mode & SSH_FXF_TRUNC != 0 {
-		flag |= os.O_TRUNC
-	}
-	if mode & SSH_FXF_EXCL != 0 {
-		flag |= os.O_EXCL
+	flag := openFlags(mode)
+	// 上游的 open 不带属性, 新建的文件在打开后设置权限
+	created := false
+	if flag & os.O_CREATE != 0 && a.Flags & ATTR_MODE != 0 {
+		_, se := sfs.client.Lstat(path)
+		created = os.IsNotExist(se)
 	}
 
-	f, e = sfs.client.OpenFile(path, flag)
+	f, e := sfs.client.OpenFile(path, flag)
 
 	if e != nil {
 		return nil, e
 	}
-	return NewSftpFile(f), nil
+	if created {
+		if e = f.Chmod(a.Mode.Perm()); e != nil {
+			f.Close()
+			return nil, e
+		}
+	}
+	sf := NewSftpFile(f)
+	sf.client = sfs.client
+	return sf, nil
 }
 
 func (sfs *sftpFs) OpenDir(path string) (Dir, error) {
@@ -163,26 +342,77 @@ func (sfs *sftpFs) Remove(path string) error {
 }
 
 func (sfs *sftpFs) Rename(oldName, newName string, flag uint32) error {
+	if flag & SSH_FXF_RENAME_OVERWRITE != 0 {
+		// 上游需要支持 posix-rename@openssh.com
+		return sfs.client.PosixRename(oldName, newName)
+	}
 	return sfs.client.Rename(oldName, newName)
 }
 
 func (sfs *sftpFs) Mkdir(path string, attr *Attr) error {
-	return sfs.client.Mkdir(path)
+	e := sfs.client.Mkdir(path)
+	if e != nil {
+		return e
+	}
+	a := *attr
+	a.Flags &^= ATTR_SIZE
+	return sfs.SetStat(path, &a)
 }
 
+// Rmdir removes an empty directory with SSH_FXP_RMDIR of the upstream, not
+// the recursive Remove of the client.
 func (sfs *sftpFs) Rmdir(path string) error {
 	return sfs.client.RemoveDirectory(path)
 }
 
 func (sfs *sftpFs) SetStat(path string, attr *Attr) error {
-	e := sfs.client.Chmod(path, attr.Mode)
-	if e != nil {
-		return e
+	var e error
+	if attr.Flags & ATTR_SIZE != 0 {
+		e = sfs.client.Truncate(path, int64(attr.Size))
+		if e != nil {
+			return e
+		}
+	}
+	if attr.Flags & ATTR_MODE != 0 {
+		e = sfs.client.Chmod(path, attr.Mode)
+		if e != nil {
+			return e
+		}
+	}
+	if attr.Flags & ATTR_UIDGID != 0 {
+		e = sfs.client.Chown(path, int(attr.Uid), int(attr.Gid))
+		if e != nil {
+			return e
+		}
+	}
+	if attr.Flags & ATTR_TIME != 0 {
+		e = sftpChtimes(sfs.client, path, attr)
 	}
-	e = sfs.client.Chown(path, int(attr.Uid), int(attr.Gid))
 	return e
 }
 
+// sftpChtimes sets the times of a, the upstream always changes both times so
+// a zero time is filled in from the current one.
+func sftpChtimes(client *sftp.Client, path string, a *Attr) error {
+	atime, mtime := a.ATime, a.MTime
+	if atime.IsZero() || mtime.IsZero() {
+		fi, e := client.Stat(path)
+		if e != nil {
+			return e
+		}
+		if mtime.IsZero() {
+			mtime = fi.ModTime()
+		}
+		if atime.IsZero() {
+			atime = mtime
+			if st, ok := fi.Sys().(*sftp.FileStat); ok {
+				atime = time.Unix(int64(st.Atime), 0)
+			}
+		}
+	}
+	return client.Chtimes(path, atime, mtime)
+}
+
 func (sfs *sftpFs) ReadLink(path string) (string, error) {
 	link, e := sfs.client.ReadLink(path)
 	if e != nil {
@@ -195,6 +425,19 @@ func (sfs *sftpFs) CreateLink(path string, target string, flags uint32) error {
 	return sfs.client.Symlink(target, path)
 }
 
+func (sfs *sftpFs) StatVFS(path string) (*StatVFS, error) {
+	st, e := sfs.client.StatVFS(path)
+	if e != nil {
+		return nil, e
+	}
+	return sftpStatVFS(st), nil
+}
+
+func (sfs *sftpFs) HardLink(oldName, newName string) error {
+	// 上游需要支持 hardlink@openssh.com
+	return sfs.client.Link(oldName, newName)
+}
+
 func (sfs *sftpFs) RealPath(pathX string) (string, error) {
 	switch pathX {
 	case "", ".":
@@ -205,6 +448,32 @@ func (sfs *sftpFs) RealPath(pathX string) (string, error) {
 	return pathX, nil
 }
 
+// UserName resolves uid with the /etc/passwd of the upstream server.
+func (sfs *sftpFs) UserName(uid uint32) string {
+	return sfs.ids.UserName(uid)
+}
+
+// GroupName resolves gid with the /etc/group of the upstream server.
+func (sfs *sftpFs) GroupName(gid uint32) string {
+	return sfs.ids.GroupName(gid)
+}
+
+// UserID resolves a user name with the /etc/passwd of the upstream server.
+func (sfs *sftpFs) UserID(name string) (uint32, bool) {
+	if lk, ok := sfs.ids.(IdentityLookup); ok {
+		return lk.UserID(name)
+	}
+	return 0, false
+}
+
+// GroupID resolves a group name with the /etc/group of the upstream server.
+func (sfs *sftpFs) GroupID(name string) (uint32, bool) {
+	if lk, ok := sfs.ids.(IdentityLookup); ok {
+		return lk.GroupID(name)
+	}
+	return 0, false
+}
+
 func publicKeyAuthFunc(pemBytes, keyPassword []byte) (ssh.AuthMethod, error) {
 	// 通过私钥创建一个 Signer 对象，在根据 Signer 对象获取 AuthMethod 对象
 	var (
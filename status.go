@@ -0,0 +1,141 @@
+package sftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/pkg/sftp"
+)
+
+// StatusError is an error that is reported to the client with Code. A
+// FileSystem returns it when the status code can not be derived from the
+// error, most errors from the os package and errnos map by themselves.
+type StatusError struct {
+	Code SSH_FX
+	Err  error
+}
+
+// NewStatusError returns a StatusError with code and message msg.
+func NewStatusError(code SSH_FX, msg string) *StatusError {
+	return &StatusError{Code: code, Err: errors.New(msg)}
+}
+
+func (e *StatusError) Error() string {
+	if e.Err == nil {
+		return e.Code.String()
+	}
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error { return e.Err }
+
+// statusCode returns the status code of the protocol version 6 for e.
+func statusCode(e error) SSH_FX {
+	if e == nil {
+		return SSH_FX_OK
+	}
+	var se *StatusError
+	if errors.As(e, &se) {
+		return se.Code
+	}
+	var ue *sftp.StatusError
+	if errors.As(e, &ue) {
+		return SSH_FX(ue.Code)
+	}
+	var errno syscall.Errno
+	if errors.As(e, &errno) {
+		if code, ok := errnoStatus(errno); ok {
+			return code
+		}
+	}
+	switch {
+	case e == io.EOF:
+		return SSH_FX_EOF
+	case errors.Is(e, os.ErrNotExist):
+		return SSH_FX_NO_SUCH_FILE
+	case errors.Is(e, os.ErrPermission):
+		return SSH_FX_PERMISSION_DENIED
+	case errors.Is(e, os.ErrExist):
+		return SSH_FX_FILE_ALREADY_EXISTS
+	case errors.Is(e, os.ErrClosed):
+		return SSH_FX_INVALID_HANDLE
+	}
+	return SSH_FX_FAILURE
+}
+
+// maxStatus is the highest status code of each protocol version.
+var maxStatus = map[uint32]SSH_FX{
+	3: SSH_FX_OP_UNSUPPORTED,
+	4: SSH_FX_NO_MEDIA,
+	5: SSH_FX_LOCK_CONFLICT,
+	6: SSH_FX_NO_MATCHING_BYTE_RANGE_LOCK,
+}
+
+// olderStatus is the code that replaces a code in earlier protocol
+// versions, codes not listed fall back to SSH_FX_FAILURE.
+var olderStatus = map[SSH_FX]SSH_FX{
+	SSH_FX_NO_SUCH_PATH:             SSH_FX_NO_SUCH_FILE,
+	SSH_FX_WRITE_PROTECT:            SSH_FX_PERMISSION_DENIED,
+	SSH_FX_CANNOT_DELETE:            SSH_FX_PERMISSION_DENIED,
+	SSH_FX_NOT_A_DIRECTORY:          SSH_FX_NO_SUCH_PATH,
+	SSH_FX_OWNER_INVALID:            SSH_FX_UNKNOWN_PRINCIPAL,
+	SSH_FX_GROUP_INVALID:            SSH_FX_UNKNOWN_PRINCIPAL,
+	SSH_FX_BYTE_RANGE_LOCK_CONFLICT: SSH_FX_LOCK_CONFLICT,
+	SSH_FX_BYTE_RANGE_LOCK_REFUSED:  SSH_FX_LOCK_CONFLICT,
+}
+
+// downgradeStatus maps code to one the protocol version knows.
+func downgradeStatus(code SSH_FX, version uint32) SSH_FX {
+	max, ok := maxStatus[version]
+	if !ok {
+		max = SSH_FX_OP_UNSUPPORTED
+	}
+	for code > max {
+		older, ok := olderStatus[code]
+		if !ok {
+			return SSH_FX_FAILURE
+		}
+		code = older
+	}
+	return code
+}
+
+// statusMessages are sent when a status has no error to describe it.
+var statusMessages = map[SSH_FX]string{
+	SSH_FX_OK:                "Success",
+	SSH_FX_EOF:               "End of file",
+	SSH_FX_NO_SUCH_FILE:      "No such file",
+	SSH_FX_PERMISSION_DENIED: "Permission denied",
+	SSH_FX_FAILURE:           "Failure",
+	SSH_FX_BAD_MESSAGE:       "Bad message",
+	SSH_FX_OP_UNSUPPORTED:    "Operation unsupported",
+	SSH_FX_INVALID_HANDLE:    "Invalid handle",
+}
+
+// statusMessage describes e for the client. The paths of os errors are left
+// out, they are paths of the server and not of the client.
+func statusMessage(code SSH_FX, e error) string {
+	if e == nil || e == io.EOF {
+		if msg, ok := statusMessages[code]; ok {
+			return msg
+		}
+		return code.String()
+	}
+	var pe *os.PathError
+	var le *os.LinkError
+	var se *os.SyscallError
+	switch {
+	case errors.As(e, &pe):
+		e = pe.Err
+	case errors.As(e, &le):
+		e = le.Err
+	case errors.As(e, &se):
+		e = se.Err
+	}
+	return e.Error()
+}
+
+// errInvalidHandle answers requests on handles that are not open.
+var errInvalidHandle = NewStatusError(SSH_FX_INVALID_HANDLE, "Invalid handle")
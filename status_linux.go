@@ -0,0 +1,44 @@
+// +build linux
+
+package sftpd
+
+import (
+	"syscall"
+)
+
+// errnoStatus maps the errnos that have a status code of their own.
+func errnoStatus(errno syscall.Errno) (SSH_FX, bool) {
+	switch errno {
+	case syscall.ENOENT:
+		return SSH_FX_NO_SUCH_FILE, true
+	case syscall.EACCES, syscall.EPERM:
+		return SSH_FX_PERMISSION_DENIED, true
+	case syscall.EEXIST:
+		return SSH_FX_FILE_ALREADY_EXISTS, true
+	case syscall.ENOSPC:
+		return SSH_FX_NO_SPACE_ON_FILESYSTEM, true
+	case syscall.EDQUOT:
+		return SSH_FX_QUOTA_EXCEEDED, true
+	case syscall.EROFS:
+		return SSH_FX_WRITE_PROTECT, true
+	case syscall.ENOTEMPTY:
+		return SSH_FX_DIR_NOT_EMPTY, true
+	case syscall.ENOTDIR:
+		return SSH_FX_NOT_A_DIRECTORY, true
+	case syscall.EISDIR:
+		return SSH_FX_FILE_IS_A_DIRECTORY, true
+	case syscall.ELOOP:
+		return SSH_FX_LINK_LOOP, true
+	case syscall.ENAMETOOLONG:
+		return SSH_FX_INVALID_FILENAME, true
+	case syscall.EINVAL:
+		return SSH_FX_INVALID_PARAMETER, true
+	case syscall.EBADF:
+		return SSH_FX_INVALID_HANDLE, true
+	case syscall.ENOSYS, syscall.EOPNOTSUPP:
+		return SSH_FX_OP_UNSUPPORTED, true
+	case syscall.ENOMEDIUM:
+		return SSH_FX_NO_MEDIA, true
+	}
+	return 0, false
+}
@@ -0,0 +1,44 @@
+// +build windows
+
+package sftpd
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// errnoStatus maps the windows errors that have a status code of their own.
+func errnoStatus(errno syscall.Errno) (SSH_FX, bool) {
+	switch errno {
+	case windows.ERROR_FILE_NOT_FOUND:
+		return SSH_FX_NO_SUCH_FILE, true
+	case windows.ERROR_PATH_NOT_FOUND:
+		return SSH_FX_NO_SUCH_PATH, true
+	case windows.ERROR_ACCESS_DENIED:
+		return SSH_FX_PERMISSION_DENIED, true
+	case windows.ERROR_FILE_EXISTS, windows.ERROR_ALREADY_EXISTS:
+		return SSH_FX_FILE_ALREADY_EXISTS, true
+	case windows.ERROR_DISK_FULL, windows.ERROR_HANDLE_DISK_FULL:
+		return SSH_FX_NO_SPACE_ON_FILESYSTEM, true
+	case windows.ERROR_WRITE_PROTECT:
+		return SSH_FX_WRITE_PROTECT, true
+	case windows.ERROR_DIR_NOT_EMPTY:
+		return SSH_FX_DIR_NOT_EMPTY, true
+	case windows.ERROR_DIRECTORY:
+		return SSH_FX_NOT_A_DIRECTORY, true
+	case windows.ERROR_INVALID_NAME, windows.ERROR_FILENAME_EXCED_RANGE:
+		return SSH_FX_INVALID_FILENAME, true
+	case windows.ERROR_INVALID_PARAMETER:
+		return SSH_FX_INVALID_PARAMETER, true
+	case windows.ERROR_INVALID_HANDLE:
+		return SSH_FX_INVALID_HANDLE, true
+	case windows.ERROR_NOT_SUPPORTED:
+		return SSH_FX_OP_UNSUPPORTED, true
+	case windows.ERROR_NOT_READY:
+		return SSH_FX_NO_MEDIA, true
+	case windows.ERROR_SHARING_VIOLATION, windows.ERROR_LOCK_VIOLATION:
+		return SSH_FX_LOCK_CONFLICT, true
+	}
+	return 0, false
+}
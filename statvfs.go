@@ -0,0 +1,88 @@
+package sftpd
+
+import (
+	"errors"
+
+	"github.com/taruti/binp"
+)
+
+// StatVFS describes the file system holding a path, the fields follow
+// statvfs(3) as used by the statvfs@openssh.com extension.
+type StatVFS struct {
+	Bsize   uint64 // file system block size
+	Frsize  uint64 // fundamental block size
+	Blocks  uint64 // size in Frsize units
+	Bfree   uint64 // free blocks
+	Bavail  uint64 // free blocks for unprivileged users
+	Files   uint64 // inodes
+	Ffree   uint64 // free inodes
+	Favail  uint64 // free inodes for unprivileged users
+	Fsid    uint64 // file system id
+	Flag    uint64 // SSH_FXE_STATVFS_ST_*
+	Namemax uint64 // maximum file name length
+}
+
+const (
+	SSH_FXE_STATVFS_ST_RDONLY = 0x1
+	SSH_FXE_STATVFS_ST_NOSUID = 0x2
+)
+
+// StatVFSer is implemented by file systems that can report their size and
+// free space.
+type StatVFSer interface {
+	StatVFS(path string) (*StatVFS, error)
+}
+
+// FStatVFSer is implemented by files that can report the size and free
+// space of the file system they are on.
+type FStatVFSer interface {
+	FStatVFS() (*StatVFS, error)
+}
+
+func hasStatVFS(s *session) bool {
+	_, ok := underlying(s.fs).(StatVFSer)
+	return ok
+}
+
+func (s *session) statVFS(id uint32, p *binp.Parser) error {
+	var path string
+	e := p.B32String(&path).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	path = s.decode(path)
+	st, e := s.fs.(StatVFSer).StatVFS(path)
+	return s.writeStatVFS(id, st, e)
+}
+
+func (s *session) fstatVFS(id uint32, p *binp.Parser) error {
+	var handle string
+	e := p.B32String(&handle).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	f := s.h.GetFile(handle)
+	if f == nil {
+		return s.writeResult(id, errInvalidHandle)
+	}
+	sf, ok := f.(FStatVFSer)
+	if _, has := underlyingFile(f).(FStatVFSer); !ok || !has {
+		return s.writeResponse(id, SSH_FX_OP_UNSUPPORTED, errors.New("UNSUPPORTED fstatvfs@openssh.com"))
+	}
+	st, e := sf.FStatVFS()
+	return s.writeStatVFS(id, st, e)
+}
+
+func (s *session) writeStatVFS(id uint32, st *StatVFS, e error) error {
+	if e != nil {
+		return s.writeResult(id, e)
+	}
+	var l binp.Len
+	o := binp.Out().LenB32(&l).LenStart(&l).Byte(SSH_FXP_EXTENDED_REPLY).B32(id)
+	o.B64(st.Bsize).B64(st.Frsize).B64(st.Blocks).B64(st.Bfree).B64(st.Bavail)
+	o.B64(st.Files).B64(st.Ffree).B64(st.Favail).B64(st.Fsid).B64(st.Flag).B64(st.Namemax)
+	o.LenDone(&l)
+	return wrc(s.out, o.Out())
+}
@@ -0,0 +1,57 @@
+// +build linux
+
+package sftpd
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func (fs *LocalFs) StatVFS(path string) (*StatVFS, error) {
+	fd, e := fs.open(path, unix.O_PATH, 0)
+	if e != nil {
+		return nil, e
+	}
+	defer unix.Close(fd)
+	var st unix.Statfs_t
+	e = unix.Fstatfs(fd, &st)
+	if e != nil {
+		return nil, &os.PathError{Op: "statfs", Path: path, Err: e}
+	}
+	return statfsToVFS(&st), nil
+}
+
+func (rf *LocalFile) FStatVFS() (*StatVFS, error) {
+	var st unix.Statfs_t
+	e := unix.Fstatfs(int(rf.file.Fd()), &st)
+	if e != nil {
+		return nil, e
+	}
+	return statfsToVFS(&st), nil
+}
+
+func statfsToVFS(st *unix.Statfs_t) *StatVFS {
+	v := &StatVFS{
+		Bsize:   uint64(st.Bsize),
+		Frsize:  uint64(st.Frsize),
+		Blocks:  uint64(st.Blocks),
+		Bfree:   uint64(st.Bfree),
+		Bavail:  uint64(st.Bavail),
+		Files:   uint64(st.Files),
+		Ffree:   uint64(st.Ffree),
+		Favail:  uint64(st.Ffree),
+		Fsid:    uint64(uint32(st.Fsid.Val[0])) | uint64(uint32(st.Fsid.Val[1]))<<32,
+		Namemax: uint64(st.Namelen),
+	}
+	if v.Frsize == 0 {
+		v.Frsize = v.Bsize
+	}
+	if st.Flags&unix.ST_RDONLY != 0 {
+		v.Flag |= SSH_FXE_STATVFS_ST_RDONLY
+	}
+	if st.Flags&unix.ST_NOSUID != 0 {
+		v.Flag |= SSH_FXE_STATVFS_ST_NOSUID
+	}
+	return v
+}
@@ -0,0 +1,45 @@
+// +build windows
+
+package sftpd
+
+import (
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+func (fs *LocalFs) StatVFS(path string) (*StatVFS, error) {
+	p, release, e := fs.resolve(path, true)
+	if e != nil {
+		return nil, e
+	}
+	defer release()
+	return diskFreeSpace(p)
+}
+
+func (rf *LocalFile) FStatVFS() (*StatVFS, error) {
+	return diskFreeSpace(filepath.Dir(rf.file.Name()))
+}
+
+// diskFreeSpace reports the volume of dir in 4 KiB blocks, windows has no
+// inode counts.
+func diskFreeSpace(dir string) (*StatVFS, error) {
+	p, e := windows.UTF16PtrFromString(dir)
+	if e != nil {
+		return nil, e
+	}
+	var avail, total, free uint64
+	e = windows.GetDiskFreeSpaceEx(p, &avail, &total, &free)
+	if e != nil {
+		return nil, e
+	}
+	const bsize = 4096
+	return &StatVFS{
+		Bsize:   bsize,
+		Frsize:  bsize,
+		Blocks:  total / bsize,
+		Bfree:   free / bsize,
+		Bavail:  avail / bsize,
+		Namemax: 255,
+	}, nil
+}
@@ -0,0 +1,181 @@
+package sftpd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/taruti/binp"
+)
+
+// nativeNewline is the newline of text files on the server.
+var nativeNewline = func() string {
+	if runtime.GOOS == "windows" {
+		return "\r\n"
+	}
+	return "\n"
+}()
+
+// canonicalNewline is the newline of text mode transfers unless the client
+// asks for another one with newline@vandyke.com.
+const canonicalNewline = "\r\n"
+
+// newlineTranslator replaces one newline sequence with another in a stream
+// that arrives in pieces.
+type newlineTranslator struct {
+	from, to []byte
+	carry    []byte
+}
+
+// translate returns bs with its newlines replaced. A trailing prefix of a
+// newline is kept back until the next call or flush.
+func (t *newlineTranslator) translate(bs []byte) []byte {
+	in := append(t.carry, bs...)
+	t.carry = nil
+	for k := len(t.from) - 1; k > 0; k-- {
+		if len(in) >= k && bytes.Equal(in[len(in)-k:], t.from[:k]) {
+			t.carry = append([]byte(nil), in[len(in)-k:]...)
+			in = in[:len(in)-k]
+			break
+		}
+	}
+	return bytes.Replace(in, t.from, t.to, -1)
+}
+
+// flush returns what translate kept back.
+func (t *newlineTranslator) flush() []byte {
+	bs := t.carry
+	t.carry = nil
+	return bs
+}
+
+// textFile serves a file opened in text mode. Offsets of READ and WRITE are
+// ignored as the protocol requires, reads and writes continue where the
+// previous one stopped and convert between the server and client newlines.
+type textFile struct {
+	File
+	mu      sync.Mutex
+	rd, wr  newlineTranslator
+	roff    int64
+	woff    int64
+	pending []byte
+	eof     bool
+}
+
+func newTextFile(f File, clientNewline string, woff int64) *textFile {
+	return &textFile{
+		File: f,
+		rd:   newlineTranslator{from: []byte(nativeNewline), to: []byte(clientNewline)},
+		wr:   newlineTranslator{from: []byte(clientNewline), to: []byte(nativeNewline)},
+		woff: woff,
+	}
+}
+
+func (t *textFile) ReadAt(bs []byte, _ int64) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.pending) < len(bs) && !t.eof {
+		buf := make([]byte, len(bs))
+		n, e := t.File.ReadAt(buf, t.roff)
+		t.roff += int64(n)
+		t.pending = append(t.pending, t.rd.translate(buf[:n])...)
+		if e == io.EOF || (e == nil && n == 0) {
+			t.pending = append(t.pending, t.rd.flush()...)
+			t.eof = true
+		} else if e != nil {
+			return 0, e
+		}
+	}
+	n := copy(bs, t.pending)
+	t.pending = t.pending[n:]
+	if n == 0 && t.eof {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (t *textFile) WriteAt(bs []byte, _ int64) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e := t.write(t.wr.translate(bs)); e != nil {
+		return 0, e
+	}
+	return len(bs), nil
+}
+
+func (t *textFile) write(bs []byte) error {
+	n, e := t.File.WriteAt(bs, t.woff)
+	t.woff += int64(n)
+	return e
+}
+
+// Sync writes a newline prefix kept back by the last write before it
+// syncs the file.
+func (t *textFile) Sync() error {
+	sf, ok := t.File.(Syncer)
+	if _, has := underlyingFile(t.File).(Syncer); !ok || !has {
+		return NewStatusError(SSH_FX_OP_UNSUPPORTED, "FILE CAN NOT BE SYNCED")
+	}
+	t.mu.Lock()
+	e := t.write(t.wr.flush())
+	t.mu.Unlock()
+	if e != nil {
+		return e
+	}
+	return sf.Sync()
+}
+
+func (t *textFile) Close() error {
+	t.mu.Lock()
+	e := t.write(t.wr.flush())
+	t.mu.Unlock()
+	if ce := t.File.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
+
+// errTextHandle answers check-file-handle and copy-data on text mode
+// handles, their offsets are of the file and not of the translated stream.
+var errTextHandle = NewStatusError(SSH_FX_OP_UNSUPPORTED, "not supported on text mode handles")
+
+// openText wraps a file opened with SSH_FXF_TEXT, appending writes start at
+// the end of the file.
+func (s *session) openText(f File, flags uint32) (File, error) {
+	var woff int64
+	if flags&SSH_FXF_APPEND != 0 {
+		a, e := f.FStat()
+		if e != nil {
+			return nil, e
+		}
+		woff = int64(a.Size)
+	}
+	s.newlineMu.Lock()
+	nl := s.newline
+	s.newlineMu.Unlock()
+	return newTextFile(f, nl, woff), nil
+}
+
+func textAvailable(s *session) bool {
+	return s.version >= 4
+}
+
+// newlineVandyke serves newline@vandyke.com, the client tells the newline
+// it wants in text mode transfers.
+func (s *session) newlineVandyke(id uint32, p *binp.Parser) error {
+	var nl string
+	e := p.B32String(&nl).End()
+	if e != nil {
+		_ = s.writeResponse(id, SSH_FX_BAD_MESSAGE, e)
+		return e
+	}
+	if nl == "" {
+		return s.writeResponse(id, SSH_FX_INVALID_PARAMETER, errors.New("empty newline"))
+	}
+	s.newlineMu.Lock()
+	s.newline = nl
+	s.newlineMu.Unlock()
+	return s.writeResult(id, nil)
+}
@@ -0,0 +1,87 @@
+package sftpd
+
+import (
+	"path"
+	"strings"
+
+	"github.com/taruti/binp"
+)
+
+// MaxVersion is the highest sftp protocol version the server implements.
+const MaxVersion = 6
+
+// MinVersion is the lowest sftp protocol version the server implements,
+// older clients are answered with it.
+const MinVersion = 3
+
+// negotiate picks the protocol version for a client that sent version v in
+// its SSH_FXP_INIT.
+func negotiate(v uint32, max int) uint32 {
+	if max < MinVersion || max > MaxVersion {
+		max = MaxVersion
+	}
+	if v > uint32(max) {
+		v = uint32(max)
+	}
+	if v < MinVersion {
+		v = MinVersion
+	}
+	return v
+}
+
+// versionReply builds SSH_FXP_VERSION, extensions holds name and data pairs.
+func versionReply(version uint32, extensions []string) []byte {
+	var l binp.Len
+	o := binp.Out().LenB32(&l).LenStart(&l).Byte(SSH_FXP_VERSION).B32(version)
+	for _, s := range extensions {
+		o.B32String(s)
+	}
+	o.LenDone(&l)
+	return o.Out()
+}
+
+// openFlagsV5 converts the desired-access and flags of a version 5 or 6
+// SSH_FXP_OPEN to the version 3 pflags used by FileSystem.OpenFile.
+func openFlagsV5(access, flags uint32) uint32 {
+	var pflags uint32
+	if access&ACE4_READ_DATA != 0 {
+		pflags |= SSH_FXF_READ
+	}
+	if access&(ACE4_WRITE_DATA|ACE4_APPEND_DATA) != 0 {
+		pflags |= SSH_FXF_WRITE
+	}
+	switch flags & SSH_FXF_ACCESS_DISPOSITION {
+	case SSH_FXF_CREATE_NEW:
+		pflags |= SSH_FXF_CREAT | SSH_FXF_EXCL
+	case SSH_FXF_CREATE_TRUNCATE:
+		pflags |= SSH_FXF_CREAT | SSH_FXF_TRUNC
+	case SSH_FXF_OPEN_OR_CREATE:
+		pflags |= SSH_FXF_CREAT
+	case SSH_FXF_TRUNCATE_EXISTING:
+		pflags |= SSH_FXF_TRUNC
+	}
+	if flags&(SSH_FXF_APPEND_DATA|SSH_FXF_APPEND_DATA_ATOMIC) != 0 {
+		pflags |= SSH_FXF_APPEND
+	}
+	if flags&SSH_FXF_TEXT_MODE != 0 {
+		pflags |= SSH_FXF_TEXT
+	}
+	return pflags
+}
+
+// optB32 parses a trailing uint32 that newer protocol versions added and
+// some clients leave out.
+func optB32(p *binp.Parser, d *uint32) *binp.Parser {
+	if p == nil || p.AtEnd() {
+		return p
+	}
+	return p.B32(d)
+}
+
+// composePath applies a compose-path of a version 6 SSH_FXP_REALPATH.
+func composePath(p, compose string) string {
+	if strings.HasPrefix(compose, "/") {
+		return compose
+	}
+	return path.Join(p, compose)
+}
@@ -0,0 +1,69 @@
+package sftpd
+
+import (
+	"strings"
+)
+
+var errNoXattrs = NewStatusError(SSH_FX_OP_UNSUPPORTED, "extended attributes are not supported")
+
+// AttrStater is implemented by file systems whose Stat reads costly
+// attributes, e.g. the extended attributes of LocalFs, which it opens the
+// file for. StatAttrs is Stat that may leave out the attributes flags does
+// not ask for.
+type AttrStater interface {
+	StatAttrs(name string, islstat bool, flags uint32) (*Attr, error)
+}
+
+// stat stats name with the attributes of want, see AttrStater. Extended
+// attributes are only read when the session allows some.
+func (s *session) stat(name string, islstat bool, want uint32) (*Attr, error) {
+	if len(s.opts.XattrNamespaces) == 0 {
+		want &^= ATTR_EXTENDED
+	}
+	if sa, ok := s.fs.(AttrStater); ok {
+		return sa.StatAttrs(name, islstat, want)
+	}
+	return s.fs.Stat(name, islstat)
+}
+
+// xattrAllowed reports whether the extended attribute name is in one of
+// the namespaces the session allows.
+func (s *session) xattrAllowed(name string) bool {
+	for _, ns := range s.opts.XattrNamespaces {
+		if strings.HasPrefix(name, ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterXattrs drops the extended attributes of a the client may not see.
+func (s *session) filterXattrs(a *Attr) {
+	if a == nil || len(a.Extended) == 0 {
+		return
+	}
+	var kept []string
+	for i := 0; i+1 < len(a.Extended); i += 2 {
+		if s.xattrAllowed(a.Extended[i]) {
+			kept = append(kept, a.Extended[i], a.Extended[i+1])
+		}
+	}
+	a.Extended = kept
+	if len(kept) == 0 {
+		a.Flags &^= ATTR_EXTENDED
+	}
+}
+
+// checkXattrs fails when the client sets extended attributes outside of
+// the allowed namespaces.
+func (s *session) checkXattrs(a *Attr) error {
+	if a.Flags&ATTR_EXTENDED == 0 {
+		return nil
+	}
+	for i := 0; i+1 < len(a.Extended); i += 2 {
+		if !s.xattrAllowed(a.Extended[i]) {
+			return NewStatusError(SSH_FX_PERMISSION_DENIED, "extended attribute "+a.Extended[i]+" not allowed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// +build linux
+
+package sftpd
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes as name and value pairs.
+// File systems without them have none.
+func readXattrs(list func([]byte) (int, error), get func(string, []byte) (int, error)) ([]string, error) {
+	buf, e := xattrCall(list)
+	if e == unix.ENOTSUP {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	var pairs []string
+	for _, name := range bytes.Split(buf, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n := string(name)
+		value, e := xattrCall(func(dest []byte) (int, error) { return get(n, dest) })
+		if e == unix.ENODATA {
+			// 列出之后被删除了
+			continue
+		}
+		if e != nil {
+			return nil, e
+		}
+		pairs = append(pairs, n, string(value))
+	}
+	return pairs, nil
+}
+
+// xattrCall asks for the size first, it retries when the value grows in
+// between.
+func xattrCall(call func([]byte) (int, error)) ([]byte, error) {
+	for {
+		size, e := call(nil)
+		if e != nil {
+			return nil, e
+		}
+		buf := make([]byte, size)
+		n, e := call(buf)
+		if e == unix.ERANGE {
+			continue
+		}
+		if e != nil {
+			return nil, e
+		}
+		return buf[:n], nil
+	}
+}
+
+// writeXattrs sets the name and value pairs of extended attributes.
+func writeXattrs(pairs []string, set func(string, []byte) error) error {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if e := set(pairs[i], []byte(pairs[i+1])); e != nil {
+			return &os.PathError{Op: "setxattr", Path: pairs[i], Err: e}
+		}
+	}
+	return nil
+}
+
+// xattrOps are the calls for the extended attributes of one file.
+type xattrOps struct {
+	list func(dest []byte) (int, error)
+	get  func(name string, dest []byte) (int, error)
+	set  func(name string, value []byte) error
+}
+
+func fdXattrOps(fd int) xattrOps {
+	return xattrOps{
+		list: func(dest []byte) (int, error) { return unix.Flistxattr(fd, dest) },
+		get:  func(name string, dest []byte) (int, error) { return unix.Fgetxattr(fd, name, dest) },
+		set:  func(name string, value []byte) error { return unix.Fsetxattr(fd, name, value, 0) },
+	}
+}
+
+func pathXattrOps(p string) xattrOps {
+	return xattrOps{
+		list: func(dest []byte) (int, error) { return unix.Llistxattr(p, dest) },
+		get:  func(name string, dest []byte) (int, error) { return unix.Lgetxattr(p, name, dest) },
+		set:  func(name string, value []byte) error { return unix.Lsetxattr(p, name, value, 0) },
+	}
+}
+
+// withXattrs runs f with the extended attribute calls of the virtual path
+// p. Linux has no *at calls for them, so the file is opened; only regular
+// files and directories are, opening a device or a FIFO can have side
+// effects, others fail with errNoXattrs. Files that may not be opened for
+// reading are reached through the directory descriptor in /proc/self/fd
+// when /proc is mounted.
+func (fs *LocalFs) withXattrs(op, p string, follow bool, f func(x xattrOps) error) error {
+	return fs.at(op, p, follow, func(dir int, name string) error {
+		var st unix.Stat_t
+		if e := unix.Fstatat(dir, name, &st, unix.AT_SYMLINK_NOFOLLOW); e != nil {
+			return e
+		}
+		if t := st.Mode & unix.S_IFMT; t != unix.S_IFREG && t != unix.S_IFDIR {
+			return errNoXattrs
+		}
+		// 跟随的链接已经解析过了, 最后一级在这之间被换成链接时失败
+		fd, e := unix.Openat(dir, name, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOCTTY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if e == unix.EACCES || e == unix.EPERM {
+			return f(pathXattrOps("/proc/self/fd/" + strconv.Itoa(dir) + "/" + name))
+		}
+		if e != nil {
+			return e
+		}
+		defer unix.Close(fd)
+		return f(fdXattrOps(fd))
+	})
+}
+
+// pathXattrs reads the extended attributes of p, files other than regular
+// files and directories have none.
+func (fs *LocalFs) pathXattrs(p string, follow bool) ([]string, error) {
+	var pairs []string
+	e := fs.withXattrs("listxattr", p, follow, func(x xattrOps) (e error) {
+		pairs, e = readXattrs(x.list, x.get)
+		return e
+	})
+	if errors.Is(e, errNoXattrs) {
+		return nil, nil
+	}
+	return pairs, e
+}
+
+func fileXattrs(f *os.File) ([]string, error) {
+	x := fdXattrOps(int(f.Fd()))
+	return readXattrs(x.list, x.get)
+}
+
+// setPathXattrs sets extended attributes of p, a symbolic link at the end
+// is followed unless follow is false.
+func (fs *LocalFs) setPathXattrs(p string, follow bool, pairs []string) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	return fs.withXattrs("setxattr", p, follow, func(x xattrOps) error {
+		return writeXattrs(pairs, x.set)
+	})
+}
+
+func setFileXattrs(f *os.File, pairs []string) error {
+	return writeXattrs(pairs, fdXattrOps(int(f.Fd())).set)
+}
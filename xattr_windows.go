@@ -0,0 +1,27 @@
+// +build windows
+
+package sftpd
+
+import (
+	"os"
+)
+
+// windows 没有 unix 的扩展属性
+
+func (fs *LocalFs) pathXattrs(p string, follow bool) ([]string, error) { return nil, nil }
+
+func fileXattrs(f *os.File) ([]string, error) { return nil, nil }
+
+func (fs *LocalFs) setPathXattrs(p string, follow bool, pairs []string) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	return errNoXattrs
+}
+
+func setFileXattrs(f *os.File, pairs []string) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	return errNoXattrs
+}